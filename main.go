@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +26,10 @@ type Report struct {
 	HasV6     bool
 	Resolvers []string
 	Test      Test
+	// Source is the address or interface set with -source.
+	Source string `json:",omitempty"`
+	// Location is the location of the client IP, with a GeoIP database.
+	Location *traceroute.Location `json:",omitempty"`
 
 	ULLPrimary    *Ping  `json:",omitempty"`
 	ULLSecondary  *Ping  `json:",omitempty"`
@@ -42,6 +49,93 @@ type Report struct {
 	SecondaryTraceroute     []traceroute.Hop `json:",omitempty"`
 	PrimaryTraceroute6      []traceroute.Hop `json:",omitempty"`
 	SecondaryTraceroute6    []traceroute.Hop `json:",omitempty"`
+
+	ULLPrimaryTracerouteTCP    []traceroute.Hop `json:",omitempty"`
+	ULLSecondaryTracerouteTCP  []traceroute.Hop `json:",omitempty"`
+	ULLPrimaryTracerouteTCP6   []traceroute.Hop `json:",omitempty"`
+	ULLSecondaryTracerouteTCP6 []traceroute.Hop `json:",omitempty"`
+	PrimaryTracerouteTCP       []traceroute.Hop `json:",omitempty"`
+	SecondaryTracerouteTCP     []traceroute.Hop `json:",omitempty"`
+	PrimaryTracerouteTCP6      []traceroute.Hop `json:",omitempty"`
+	SecondaryTracerouteTCP6    []traceroute.Hop `json:",omitempty"`
+
+	PrimaryMultipath    *traceroute.Graph `json:",omitempty"`
+	SecondaryMultipath  *traceroute.Graph `json:",omitempty"`
+	PrimaryMultipath6   *traceroute.Graph `json:",omitempty"`
+	SecondaryMultipath6 *traceroute.Graph `json:",omitempty"`
+
+	ULLPrimaryPMTU    *traceroute.PMTU `json:",omitempty"`
+	ULLSecondaryPMTU  *traceroute.PMTU `json:",omitempty"`
+	ULLPrimaryPMTU6   *traceroute.PMTU `json:",omitempty"`
+	ULLSecondaryPMTU6 *traceroute.PMTU `json:",omitempty"`
+	PrimaryPMTU       *traceroute.PMTU `json:",omitempty"`
+	SecondaryPMTU     *traceroute.PMTU `json:",omitempty"`
+	PrimaryPMTU6      *traceroute.PMTU `json:",omitempty"`
+	SecondaryPMTU6    *traceroute.PMTU `json:",omitempty"`
+
+	// DSCPTraceroutes trace the anycast primary PoPs with each of the DSCP
+	// values set with -dscp, to compare with PrimaryTraceroute and
+	// PrimaryTraceroute6.
+	DSCPTraceroutes []DSCPTraceroute `json:",omitempty"`
+
+	TracerouteErrors    []TraceError   `json:",omitempty"`
+	TracerouteSummaries []TraceSummary `json:",omitempty"`
+
+	// skipTraces holds, by method and family, the errors of traces which
+	// cannot succeed on this host and are thus not attempted again.
+	skipTraces map[string]error
+	// lastHops holds, by destination IP, the hops of the last successful
+	// trace, compared with by the next one.
+	lastHops map[string][]traceroute.Hop
+	// names resolves the names of the hops of all traces.
+	names *traceroute.NameResolver
+	// asn annotates the hops of all traces with their AS, if loaded.
+	asn *traceroute.ASNDB
+	// geo locates the hops of all traces and the PoPs, if loaded.
+	geo *traceroute.GeoDB
+}
+
+// DSCPTraceroute is a traceroute with probes marked with a DSCP value.
+type DSCPTraceroute struct {
+	Dest string
+	DSCP int
+	Hops []traceroute.Hop `json:",omitempty"`
+}
+
+// TraceError records why a traceroute failed.
+type TraceError struct {
+	Name   string
+	Dest   string
+	Method string
+	// Reason is one of permission, unsupported_family, unsupported, socket,
+	// parse, canceled, resolve or other.
+	Reason string
+	Error  string
+}
+
+// TraceSummary holds the analysis of a successful traceroute.
+type TraceSummary struct {
+	Name   string
+	Dest   string
+	Method string
+	// Stop tells why the trace stopped, e.g. at the destination or after
+	// too many silent hops.
+	Stop traceroute.StopReason
+	// ASPath lists the ASes crossed, in order. It requires an AS database.
+	ASPath []traceroute.ASInfo `json:",omitempty"`
+	// GeoCheck compares the RTT to the destination with its distance. It
+	// requires a GeoIP database.
+	GeoCheck *traceroute.GeoCheck `json:",omitempty"`
+	// Middleboxes lists the modifications of the probes on the path, like
+	// NAT or DSCP bleaching. Rewritten IPv4 identifications are not
+	// detected, the kernel picking the identification of probes.
+	Middleboxes []traceroute.Middlebox `json:",omitempty"`
+	// HopNotes lists the hops whose loss or latency does not affect the
+	// traffic they forward, like ICMP rate limiting.
+	HopNotes []traceroute.HopNote `json:",omitempty"`
+	// Anomalies lists the routing anomalies found on the path, like loops
+	// or private addresses after public ones.
+	Anomalies []traceroute.Anomaly `json:",omitempty"`
 }
 
 type Test struct {
@@ -72,6 +166,14 @@ type Ping struct {
 	Pop      string `json:",omitempty"`
 	Protocol int
 	RTT      time.Duration
+	IP       string `json:",omitempty"`
+
+	// Location and GeoCheck require a GeoIP database.
+	Location *traceroute.Location `json:",omitempty"`
+	GeoCheck *traceroute.GeoCheck `json:",omitempty"`
+	// ICMP holds the RTTs of ICMP Echo requests sent to IP, to compare with
+	// RTT.
+	ICMP *traceroute.PingStats `json:",omitempty"`
 }
 
 func (p Ping) String() string {
@@ -85,7 +187,78 @@ type RouterTarget struct {
 	IPs []string
 }
 
+var (
+	// source and iface are the address and interface set with -source,
+	// which dialer and client also bind to.
+	source net.IP
+	iface  string
+	dialer = &traceroute.Dialer{}
+	client = http.DefaultClient
+)
+
 func main() {
+	mtrTarget := flag.String("mtr", "", "Continuously trace the route to `target` instead of running the diagnostic:\n"+
+		"primary, secondary, ull-primary or ull-secondary, with a 6 suffix for IPv6, or any host")
+	count := flag.Int("count", 0, "Number of cycles to run with -mtr, until interrupted if zero")
+	duration := flag.Duration("duration", 0, "Maximum time to run with -mtr, until interrupted if zero")
+	interval := flag.Duration("interval", traceroute.DefaultMonitorInterval, "Time between two cycles with -mtr")
+	history := flag.Int("history", traceroute.DefaultMonitorHistory, "Number of most recent `samples` per hop the -mtr statistics account for, all if negative")
+	asnDB := flag.String("asn-db", "", "Annotate hops with their AS using the ip2asn TSV or prefix table at `path`")
+	geoDB := flag.String("geo-db", "", "Locate hops and PoPs using the MaxMind DB (GeoLite2-City or similar) at `path`")
+	sourceFlag := flag.String("source", "", "Send all probes and HTTP requests from the local `address or interface`,\n"+
+		"to test one uplink of a multi-homed host")
+	dscpFlag := flag.String("dscp", "", "Also trace the anycast primary PoPs with each of the comma-separated DSCP `values`,\n"+
+		"e.g. 46,34,8, to compare how they are routed")
+	flag.Parse()
+
+	dscps, err := parseDSCPs(*dscpFlag)
+	if err != nil {
+		fmt.Printf("Invalid -dscp: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *sourceFlag != "" {
+		if source = net.ParseIP(*sourceFlag); source == nil {
+			iface = *sourceFlag
+		}
+		var err error
+		if dialer, err = traceroute.NewDialer(source, iface); err != nil {
+			fmt.Printf("Cannot use source %s: %v\n", *sourceFlag, err)
+			os.Exit(1)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = dialer.DialContext
+		client = &http.Client{Transport: t}
+	}
+
+	var asn *traceroute.ASNDB
+	if *asnDB != "" {
+		var err error
+		if asn, err = traceroute.OpenASNDB(*asnDB); err != nil {
+			fmt.Printf("Cannot load AS database: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var geo *traceroute.GeoDB
+	if *geoDB != "" {
+		var err error
+		if geo, err = traceroute.OpenGeoDB(*geoDB); err != nil {
+			fmt.Printf("Cannot load GeoIP database: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *mtrTarget != "" {
+		if resolvers := host.DNS(); len(resolvers) > 0 {
+			useResolver(resolvers[0])
+		}
+		if err := mtr(*mtrTarget, *count, *duration, *interval, *history, asn, geo); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if runtime.GOOS == "windows" {
 		fmt.Println("")
 		fmt.Println("Welcome to NextDNS network diagnostic tool.")
@@ -100,18 +273,21 @@ func main() {
 	}
 
 	var r Report
+	r.Source = *sourceFlag
 
 	if r.Resolvers = host.DNS(); len(r.Resolvers) > 0 {
 		fmt.Println("Resolvers: ", strings.Join(r.Resolvers, ", "))
-		net.DefaultResolver.PreferGo = true
-		d := &net.Dialer{}
-		net.DefaultResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-			return d.DialContext(ctx, network, net.JoinHostPort(r.Resolvers[0], "53"))
-		}
+		useResolver(r.Resolvers[0])
 	}
+	r.names = &traceroute.NameResolver{Resolver: net.DefaultResolver}
+	r.asn = asn
+	r.geo = geo
 
 	r.HasV6 = hasIPv6()
 	r.Test = test()
+	if ip := net.ParseIP(r.Test.Client); ip != nil && r.geo != nil {
+		r.Location = r.geo.Lookup(ip)
+	}
 	r.ULLPrimary = pop("ultra low latency primary IPv4", "ipv4.dns1.nextdns.io")
 	r.ULLSecondary = pop("ultra low latency secondary IPv4", "ipv4.dns2.nextdns.io")
 	r.Primary = pop("anycast primary IPv4", "45.90.28.0")
@@ -123,15 +299,68 @@ func main() {
 		r.Secondary6 = pop("anycast secondary IPv6", "2a07:a8c1::")
 	}
 	r.Top = pings(r.HasV6)
-	r.ULLPrimaryTraceroute = trace("ultra low latency primary IPv4", "ipv4.dns1.nextdns.io")
-	r.ULLSecondaryTraceroute = trace("ultra low latency secondary IPv4", "ipv4.dns2.nextdns.io")
-	r.PrimaryTraceroute = trace("anycast primary IPv4", "45.90.28.0")
-	r.SecondaryTraceroute = trace("anycast secondary IPv4", "45.90.30.0")
+	// pops are the PoPs tested over HTTP, to locate and ping over ICMP. The
+	// IPv6 ones are nil without IPv6.
+	pops := []*Ping{r.ULLPrimary, r.ULLSecondary, r.Primary, r.Secondary,
+		r.ULLPrimary6, r.ULLSecondary6, r.Primary6, r.Secondary6}
+	for i := range r.Top {
+		pops = append(pops, &r.Top[i])
+	}
+	for _, p := range pops {
+		r.locate(p)
+	}
+	icmpPings(pops)
+	r.ULLPrimaryTraceroute = r.trace("ultra low latency primary IPv4", "ipv4.dns1.nextdns.io", traceroute.MethodICMP)
+	r.ULLSecondaryTraceroute = r.trace("ultra low latency secondary IPv4", "ipv4.dns2.nextdns.io", traceroute.MethodICMP)
+	r.PrimaryTraceroute = r.trace("anycast primary IPv4", "45.90.28.0", traceroute.MethodICMP)
+	r.SecondaryTraceroute = r.trace("anycast secondary IPv4", "45.90.30.0", traceroute.MethodICMP)
+	if r.HasV6 {
+		r.ULLPrimaryTraceroute6 = r.trace("ultra low latency primary IPv6", "ipv6.dns1.nextdns.io", traceroute.MethodICMP)
+		r.ULLSecondaryTraceroute6 = r.trace("ultra low latency secondary IPv6", "ipv6.dns2.nextdns.io", traceroute.MethodICMP)
+		r.PrimaryTraceroute6 = r.trace("anycast primary IPv6", "2a07:a8c0::", traceroute.MethodICMP)
+		r.SecondaryTraceroute6 = r.trace("anycast secondary IPv6", "2a07:a8c1::", traceroute.MethodICMP)
+	}
+	for _, dscp := range dscps {
+		r.DSCPTraceroutes = append(r.DSCPTraceroutes, DSCPTraceroute{
+			Dest: "45.90.28.0",
+			DSCP: dscp,
+			Hops: r.traceDSCP("anycast primary IPv4", "45.90.28.0", traceroute.MethodICMP, dscp),
+		})
+		if r.HasV6 {
+			r.DSCPTraceroutes = append(r.DSCPTraceroutes, DSCPTraceroute{
+				Dest: "2a07:a8c0::",
+				DSCP: dscp,
+				Hops: r.traceDSCP("anycast primary IPv6", "2a07:a8c0::", traceroute.MethodICMP, dscp),
+			})
+		}
+	}
+	if runtime.GOOS != "windows" {
+		r.ULLPrimaryTracerouteTCP = r.trace("ultra low latency primary IPv4", "ipv4.dns1.nextdns.io", traceroute.MethodTCP)
+		r.ULLSecondaryTracerouteTCP = r.trace("ultra low latency secondary IPv4", "ipv4.dns2.nextdns.io", traceroute.MethodTCP)
+		r.PrimaryTracerouteTCP = r.trace("anycast primary IPv4", "45.90.28.0", traceroute.MethodTCP)
+		r.SecondaryTracerouteTCP = r.trace("anycast secondary IPv4", "45.90.30.0", traceroute.MethodTCP)
+		if r.HasV6 {
+			r.ULLPrimaryTracerouteTCP6 = r.trace("ultra low latency primary IPv6", "ipv6.dns1.nextdns.io", traceroute.MethodTCP)
+			r.ULLSecondaryTracerouteTCP6 = r.trace("ultra low latency secondary IPv6", "ipv6.dns2.nextdns.io", traceroute.MethodTCP)
+			r.PrimaryTracerouteTCP6 = r.trace("anycast primary IPv6", "2a07:a8c0::", traceroute.MethodTCP)
+			r.SecondaryTracerouteTCP6 = r.trace("anycast secondary IPv6", "2a07:a8c1::", traceroute.MethodTCP)
+		}
+		r.PrimaryMultipath = r.multipath("anycast primary IPv4", "45.90.28.0")
+		r.SecondaryMultipath = r.multipath("anycast secondary IPv4", "45.90.30.0")
+		if r.HasV6 {
+			r.PrimaryMultipath6 = r.multipath("anycast primary IPv6", "2a07:a8c0::")
+			r.SecondaryMultipath6 = r.multipath("anycast secondary IPv6", "2a07:a8c1::")
+		}
+	}
+	r.ULLPrimaryPMTU = r.pmtu("ultra low latency primary IPv4", "ipv4.dns1.nextdns.io")
+	r.ULLSecondaryPMTU = r.pmtu("ultra low latency secondary IPv4", "ipv4.dns2.nextdns.io")
+	r.PrimaryPMTU = r.pmtu("anycast primary IPv4", "45.90.28.0")
+	r.SecondaryPMTU = r.pmtu("anycast secondary IPv4", "45.90.30.0")
 	if r.HasV6 {
-		r.ULLPrimaryTraceroute6 = trace("ultra low latency primary IPv6", "ipv6.dns1.nextdns.io")
-		r.ULLSecondaryTraceroute6 = trace("ultra low latency secondary IPv6", "ipv6.dns2.nextdns.io")
-		r.PrimaryTraceroute6 = trace("anycast primary IPv6", "2a07:a8c0::")
-		r.SecondaryTraceroute6 = trace("anycast secondary IPv6", "2a07:a8c1::")
+		r.ULLPrimaryPMTU6 = r.pmtu("ultra low latency primary IPv6", "ipv6.dns1.nextdns.io")
+		r.ULLSecondaryPMTU6 = r.pmtu("ultra low latency secondary IPv6", "ipv6.dns2.nextdns.io")
+		r.PrimaryPMTU6 = r.pmtu("anycast primary IPv6", "2a07:a8c0::")
+		r.SecondaryPMTU6 = r.pmtu("anycast secondary IPv6", "2a07:a8c1::")
 	}
 
 	fmt.Print("Do you want to send this report? [Y/n]: ")
@@ -173,9 +402,17 @@ func main() {
 	}
 }
 
+// useResolver makes the default resolver send its queries to resolver.
+func useResolver(resolver string) {
+	net.DefaultResolver.PreferGo = true
+	net.DefaultResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(resolver, "53"))
+	}
+}
+
 func hasIPv6() bool {
 	fmt.Println("Testing IPv6 connectivity")
-	c, err := net.Dial("tcp", "[2620:fe::fe]:443")
+	c, err := dialer.Dial("tcp", "[2620:fe::fe]:443")
 	if c != nil {
 		c.Close()
 	}
@@ -184,22 +421,45 @@ func hasIPv6() bool {
 	return v6
 }
 
-func trace(name string, dest string) []traceroute.Hop {
-	ip := net.ParseIP(dest)
-	if ip == nil {
-		ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", dest)
-		if err != nil {
-			fmt.Printf(indent("Traceroute error: %v\n"), err)
-			return nil
-		}
-		if len(ips) == 0 {
-			fmt.Print(indent("Traceroute error: no IP for host\n"))
-			return nil
-		}
-		ip = ips[0]
+func (r *Report) trace(name string, dest string, method traceroute.Method) []traceroute.Hop {
+	return r.traceDSCP(name, dest, method, 0)
+}
+
+// traceDSCP traces the route to dest with probes marked with dscp.
+func (r *Report) traceDSCP(name string, dest string, method traceroute.Method, dscp int) []traceroute.Hop {
+	if dscp != 0 {
+		name = fmt.Sprintf("%s with DSCP %d", name, dscp)
+	}
+	ip, err := lookupIP(dest)
+	if err != nil {
+		fmt.Printf(indent("Traceroute error: %v\n"), err)
+		r.traceFailed(name, dest, method.String(), "resolve", err)
+		return nil
+	}
+	t := traceroute.Tracer{
+		Method: method,
+		// Keep probes on a single path through load balancers.
+		Paris:     runtime.GOOS != "windows",
+		Names:     r.names,
+		ASN:       r.asn,
+		Geo:       r.geo,
+		Source:    source,
+		Interface: iface,
+		TOS:       dscp << 2,
+		// Do not wait for the remaining hops of unreachable destinations.
+		GapLimit: 5,
+	}
+	if method == traceroute.MethodICMP {
+		fmt.Printf("Traceroute for %s (%s)\n", name, ip)
+	} else {
+		fmt.Printf("%s traceroute for %s (%s)\n", strings.ToUpper(method.String()), name, ip)
+	}
+	key := traceKey(method.String(), ip)
+	if err := r.skipTraces[key]; err != nil {
+		fmt.Printf(indent("skipped: %v\n"), err)
+		r.traceFailed(name, dest, method.String(), failureReason(err), err)
+		return nil
 	}
-	fmt.Printf("Traceroute for %s (%s)\n", name, ip)
-	var t traceroute.Tracer
 	c := make(chan traceroute.Hop)
 	var hops []traceroute.Hop
 	var wg sync.WaitGroup
@@ -211,20 +471,278 @@ func trace(name string, dest string) []traceroute.Hop {
 			fmt.Println(indent(hop.String()))
 		}
 	}()
-	err := t.Trace(context.Background(), ip, c)
+	res, err := t.TraceResult(context.Background(), ip, c)
 	if err != nil {
 		fmt.Printf(indent("error: %v\n"), err)
+		r.traceFailed(name, dest, method.String(), failureReason(err), err)
+		r.skipIfUnsupported(key, err)
 	}
 	close(c)
 	wg.Wait()
+	if err == nil {
+		r.summarize(name, dest, method.String(), ip, res)
+	}
 	return hops
 }
 
+// summarize records the analysis of the hops of a successful trace.
+func (r *Report) summarize(name, dest, method string, ip net.IP, res *traceroute.Result) {
+	hops := res.Hops
+	s := TraceSummary{
+		Name:   name,
+		Dest:   dest,
+		Method: method,
+		Stop:   res.Stop,
+	}
+	if s.Stop != traceroute.StopDestination {
+		fmt.Printf(indent("Stopped: %s\n"), s.Stop)
+	}
+	if r.asn != nil {
+		s.ASPath = traceroute.ASPath(hops)
+		if len(s.ASPath) > 0 {
+			path := make([]string, len(s.ASPath))
+			for i, as := range s.ASPath {
+				path[i] = as.String()
+			}
+			fmt.Printf(indent("AS path: %s\n"), strings.Join(path, " > "))
+		}
+	}
+	if r.geo != nil && len(hops) > 0 {
+		// Use the best RTT to the destination, if reached.
+		var rtt time.Duration
+		for _, info := range hops[len(hops)-1].Info {
+			if info.IP.Equal(ip) && info.RTT > 0 && (rtt == 0 || info.RTT < rtt) {
+				rtt = info.RTT
+			}
+		}
+		if s.GeoCheck = traceroute.CheckRTT(r.Location, r.geo.Lookup(ip), rtt); s.GeoCheck != nil {
+			fmt.Printf(indent("Geo check: %s\n"), s.GeoCheck)
+		}
+	}
+	s.Middleboxes = traceroute.Middleboxes(hops)
+	for _, m := range s.Middleboxes {
+		fmt.Printf(indent("Middlebox: %s\n"), m)
+	}
+	s.HopNotes = traceroute.HopNotes(hops)
+	for _, n := range s.HopNotes {
+		fmt.Printf(indent("Not a forwarding problem: %s\n"), n)
+	}
+	s.Anomalies = traceroute.Anomalies(hops, ip, r.lastHops[ip.String()])
+	for _, a := range s.Anomalies {
+		fmt.Printf(indent("Anomaly: %s\n"), a)
+	}
+	if r.lastHops == nil {
+		r.lastHops = map[string][]traceroute.Hop{}
+	}
+	r.lastHops[ip.String()] = hops
+	r.TracerouteSummaries = append(r.TracerouteSummaries, s)
+}
+
+func (r *Report) multipath(name string, dest string) *traceroute.Graph {
+	fmt.Printf("Multipath traceroute for %s (%s)\n", name, dest)
+	ip := net.ParseIP(dest)
+	key := traceKey("multipath", ip)
+	if err := r.skipTraces[key]; err != nil {
+		fmt.Printf(indent("skipped: %v\n"), err)
+		r.traceFailed(name, dest, "multipath", failureReason(err), err)
+		return nil
+	}
+	t := traceroute.Tracer{
+		// Many probes are sent per hop, don't wait too long on silent ones.
+		HopTimeout: 2 * time.Second,
+		// Do not wait for the remaining hops of unreachable destinations.
+		GapLimit:  5,
+		Source:    source,
+		Interface: iface,
+	}
+	g, err := t.TraceMultipath(context.Background(), ip)
+	if err != nil {
+		fmt.Printf(indent("error: %v\n"), err)
+		r.traceFailed(name, dest, "multipath", failureReason(err), err)
+		r.skipIfUnsupported(key, err)
+		return nil
+	}
+	fmt.Println(indent(g.String()))
+	return g
+}
+
+// pmtu discovers the path MTU toward dest.
+func (r *Report) pmtu(name string, dest string) *traceroute.PMTU {
+	ip, err := lookupIP(dest)
+	if err != nil {
+		fmt.Printf(indent("Path MTU error: %v\n"), err)
+		r.traceFailed(name, dest, "pmtu", "resolve", err)
+		return nil
+	}
+	fmt.Printf("Path MTU for %s (%s)\n", name, ip)
+	key := traceKey("pmtu", ip)
+	if err := r.skipTraces[key]; err != nil {
+		fmt.Printf(indent("skipped: %v\n"), err)
+		r.traceFailed(name, dest, "pmtu", failureReason(err), err)
+		return nil
+	}
+	t := traceroute.Tracer{
+		// Blackholes only show as lost probes, don't wait too long on
+		// them.
+		HopTimeout: time.Second,
+		Probes:     2,
+		MaxHops:    64,
+		Source:     source,
+		Interface:  iface,
+	}
+	p, err := t.PMTU(context.Background(), ip)
+	if err != nil {
+		fmt.Printf(indent("error: %v\n"), err)
+		r.traceFailed(name, dest, "pmtu", failureReason(err), err)
+		r.skipIfUnsupported(key, err)
+		return nil
+	}
+	fmt.Println(indent(p.String()))
+	return p
+}
+
+// parseDSCPs parses a comma-separated list of DSCP values.
+func parseDSCPs(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var dscps []int
+	for _, v := range strings.Split(s, ",") {
+		dscp, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if dscp < 0 || dscp > 63 {
+			return nil, fmt.Errorf("%d out of range [0, 63]", dscp)
+		}
+		dscps = append(dscps, dscp)
+	}
+	return dscps, nil
+}
+
+// lookupIP returns the IP of dest, an IP or a host name.
+func lookupIP(dest string) (net.IP, error) {
+	if ip := net.ParseIP(dest); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", dest)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IP for host")
+	}
+	return ips[0], nil
+}
+
+// locate sets the location of the PoP of p, and checks its RTT against its
+// distance.
+func (r *Report) locate(p *Ping) {
+	if r.geo == nil || p == nil {
+		return
+	}
+	ip := net.ParseIP(p.IP)
+	if ip == nil {
+		return
+	}
+	p.Location = r.geo.Lookup(ip)
+	if p.GeoCheck = traceroute.CheckRTT(r.Location, p.Location, p.RTT); p.GeoCheck != nil && p.GeoCheck.Verdict != "ok" {
+		fmt.Printf(indent("Geo check for %s (%s): %s\n"), p.Pop, p.Location, p.GeoCheck)
+	}
+}
+
+// icmpPings pings the PoPs over ICMP in parallel, to tell the latency of the
+// network from the one of the HTTP stack.
+func icmpPings(ps []*Ping) {
+	fmt.Println("Pinging PoPs over ICMP")
+	errs := make([]error, len(ps))
+	// Share one socket per family rather than each pinger reading all the
+	// replies of the others.
+	var mux traceroute.Mux
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		if p == nil || net.ParseIP(p.IP) == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p *Ping) {
+			defer wg.Done()
+			pi := traceroute.Pinger{
+				Interval:  200 * time.Millisecond,
+				Timeout:   2 * time.Second,
+				Source:    source,
+				Interface: iface,
+				Mux:       &mux,
+			}
+			p.ICMP, errs[i] = pi.Ping(context.Background(), net.ParseIP(p.IP))
+		}(i, p)
+	}
+	wg.Wait()
+	for i, p := range ps {
+		switch {
+		case errs[i] != nil:
+			fmt.Printf(indent("%s (%s): error: %v\n"), p.Pop, p.IP, errs[i])
+		case p != nil && p.ICMP != nil:
+			fmt.Printf(indent("%s (%s): %s (HTTP %s)\n"), p.Pop, p.IP, p.ICMP, p.RTT)
+		}
+	}
+}
+
+func (r *Report) traceFailed(name, dest, method, reason string, err error) {
+	r.TracerouteErrors = append(r.TracerouteErrors, TraceError{
+		Name:   name,
+		Dest:   dest,
+		Method: method,
+		Reason: reason,
+		Error:  err.Error(),
+	})
+}
+
+// skipIfUnsupported records err so that following traces of the same kind
+// are skipped if it means they cannot succeed on this host.
+func (r *Report) skipIfUnsupported(key string, err error) {
+	if !errors.Is(err, traceroute.ErrPermission) &&
+		!errors.Is(err, traceroute.ErrUnsupportedFamily) &&
+		!errors.Is(err, traceroute.ErrUnsupported) {
+		return
+	}
+	if r.skipTraces == nil {
+		r.skipTraces = map[string]error{}
+	}
+	r.skipTraces[key] = err
+}
+
+func traceKey(method string, ip net.IP) string {
+	if ip.To4() != nil {
+		return method + "4"
+	}
+	return method + "6"
+}
+
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, traceroute.ErrPermission):
+		return "permission"
+	case errors.Is(err, traceroute.ErrUnsupportedFamily):
+		return "unsupported_family"
+	case errors.Is(err, traceroute.ErrUnsupported):
+		return "unsupported"
+	case errors.Is(err, traceroute.ErrSocket):
+		return "socket"
+	case errors.Is(err, traceroute.ErrParse):
+		return "parse"
+	case errors.Is(err, traceroute.ErrCanceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
 func test() Test {
 	fmt.Println("Fetching https://test.nextdns.io")
 	req, _ := http.NewRequest("GET", "https://test.nextdns.io", nil)
 	req.Header.Set("User-Agent", "curl")
-	res, err := http.DefaultClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		fmt.Printf(indent("Fetch error: %v\n"), err)
 		return Test{}
@@ -245,11 +763,15 @@ func test() Test {
 func pop(name, target string) *Ping {
 	fmt.Printf("Fetching PoP name for %s (%s)\n", name, target)
 	req, _ := http.NewRequest("GET", "https://dns.nextdns.io/info", nil)
+	var remoteIP string
 	cl := http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-				d := net.Dialer{}
-				return d.DialContext(ctx, network, net.JoinHostPort(target, "443"))
+				c, err := dialer.DialContext(ctx, network, net.JoinHostPort(target, "443"))
+				if err == nil {
+					remoteIP, _, _ = net.SplitHostPort(c.RemoteAddr().String())
+				}
+				return c, err
 			},
 		},
 	}
@@ -269,13 +791,14 @@ func pop(name, target string) *Ping {
 		fmt.Printf(indent("Cannot decode response: %v\n"), err)
 	}
 	p.RTT *= 1000
+	p.IP = remoteIP
 	fmt.Println(indent(p.String()))
 	return &p
 }
 
 func pings(v6 bool) []Ping {
 	fmt.Println("Pinging PoPs")
-	res, err := http.Get("https://router.nextdns.io/?limit=10&stack=dual")
+	res, err := client.Get("https://router.nextdns.io/?limit=10&stack=dual")
 	if err != nil {
 		fmt.Printf(indent("error: %v\n"), err)
 		return nil
@@ -315,7 +838,7 @@ func ping(ip string) (p Ping) {
 	if net.ParseIP(ip).To4() == nil {
 		p.Protocol = 6
 	}
-	res, err := http.Get("http://" + net.JoinHostPort(ip, "80") + "/info")
+	res, err := client.Get("http://" + net.JoinHostPort(ip, "80") + "/info")
 	if err != nil {
 		return p
 	}
@@ -323,6 +846,7 @@ func ping(ip string) (p Ping) {
 	j := json.NewDecoder(res.Body)
 	_ = j.Decode(&p)
 	p.RTT *= 1000
+	p.IP = ip
 	return p
 
 }
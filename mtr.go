@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nextdns/diag/traceroute"
+)
+
+// mtrTargets maps the target names accepted by -mtr to NextDNS endpoints.
+var mtrTargets = map[string]string{
+	"ull-primary":    "ipv4.dns1.nextdns.io",
+	"ull-secondary":  "ipv4.dns2.nextdns.io",
+	"ull-primary6":   "ipv6.dns1.nextdns.io",
+	"ull-secondary6": "ipv6.dns2.nextdns.io",
+	"primary":        "45.90.28.0",
+	"secondary":      "45.90.30.0",
+	"primary6":       "2a07:a8c0::",
+	"secondary6":     "2a07:a8c1::",
+}
+
+// mtr continuously traces the route to target, redrawing a table of the hop
+// statistics over the last history samples after each cycle until count
+// cycles are done, duration elapsed or the user interrupts it.
+func mtr(target string, count int, duration, interval time.Duration, history int, asn *traceroute.ASNDB, geo *traceroute.GeoDB) error {
+	dest := target
+	if d, found := mtrTargets[target]; found {
+		dest = d
+	}
+	ip := net.ParseIP(dest)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", dest)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return errors.New("no IP for host")
+		}
+		ip = ips[0]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	m := traceroute.Monitor{
+		Tracer: traceroute.Tracer{
+			// Keep a cycle short when some hops never reply.
+			HopTimeout: 2 * time.Second,
+			Paris:      runtime.GOOS != "windows",
+			Names:      &traceroute.NameResolver{Resolver: net.DefaultResolver},
+			ASN:        asn,
+			Geo:        geo,
+			Source:     source,
+			Interface:  iface,
+		},
+		Interval: interval,
+		Count:    count,
+		Duration: duration,
+		History:  history,
+	}
+	c := make(chan traceroute.Snapshot)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Run(ctx, ip, c)
+		close(c)
+	}()
+	for s := range c {
+		// Clear the screen and move the cursor to the top.
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Continuous traceroute for %s (%s), cycle %d\n", target, ip, s.Cycle)
+		fmt.Println(indent(mtrTable(s.Hops)))
+		for _, n := range traceroute.HopNotes(s.Hops) {
+			fmt.Printf(indent("Not a forwarding problem: %s\n"), n)
+		}
+	}
+	err := <-errc
+	if errors.Is(err, context.Canceled) {
+		// Interrupted by the user.
+		return nil
+	}
+	return err
+}
+
+func mtrTable(hops []traceroute.Hop) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-3s %-32s %6s %5s %7s %7s %7s %7s %7s %7s", "", "Host", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev", "Jttr")
+	for _, h := range hops {
+		host := "???"
+		if ips := h.IPs(); len(ips) > 0 {
+			s := make([]string, len(ips))
+			for i, ip := range ips {
+				s[i] = ip.String()
+				if name := h.Name(ip); name != "" {
+					s[i] = name
+				}
+				if as := h.AS(ip); as != nil {
+					s[i] = fmt.Sprintf("[AS%d] %s", as.Number, s[i])
+				}
+			}
+			host = strings.Join(s, ", ")
+		}
+		var last time.Duration = -1
+		if len(h.Info) > 0 {
+			last = h.Info[len(h.Info)-1].RTT
+		}
+		st := h.Stats()
+		rtts := []time.Duration{st.Avg, st.Min, st.Max, st.StdDev, st.Jitter}
+		if st.Received == 0 {
+			// The statistics are zero without any reply.
+			for i := range rtts {
+				rtts[i] = -1
+			}
+		}
+		fmt.Fprintf(&sb, "\n%-3s %-32s %5.1f%% %5d %7s %7s %7s %7s %7s %7s",
+			fmt.Sprintf("%d.", h.Seq), host, st.Loss*100, st.Sent,
+			mtrRTT(last), mtrRTT(rtts[0]), mtrRTT(rtts[1]), mtrRTT(rtts[2]), mtrRTT(rtts[3]), mtrRTT(rtts[4]))
+	}
+	return sb.String()
+}
+
+func mtrRTT(d time.Duration) string {
+	if d < 0 {
+		return "*"
+	}
+	return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nextdns/diag/traceroute"
+)
+
+func TestMTRTable(t *testing.T) {
+	hops := []traceroute.Hop{
+		{Seq: 1, Info: []traceroute.HopInfo{
+			{IP: net.IPv4(192, 0, 2, 1), RTT: 2 * time.Millisecond},
+			{IP: net.IPv4(192, 0, 2, 1), RTT: 4 * time.Millisecond},
+		}},
+		{Seq: 2, Info: []traceroute.HopInfo{{RTT: -1}, {RTT: -1}}},
+	}
+	lines := strings.Split(mtrTable(hops), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("table has %d lines, want 3:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	want := [][]string{
+		{"1.", "192.0.2.1", "0.0%", "2", "4.0", "3.0", "2.0", "4.0", "1.0", "2.0"},
+		{"2.", "???", "100.0%", "2", "*", "*", "*", "*", "*", "*"},
+	}
+	for i, w := range want {
+		if got := strings.Fields(lines[i+1]); strings.Join(got, " ") != strings.Join(w, " ") {
+			t.Errorf("hop %d row = %q, want %q", i+1, got, w)
+		}
+	}
+}
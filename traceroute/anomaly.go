@@ -0,0 +1,280 @@
+package traceroute
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Kinds of routing anomalies found on a path.
+const (
+	// AnomalyLoop is an address replying at non-adjacent TTLs, probes
+	// going through the same router twice.
+	AnomalyLoop = "loop"
+	// AnomalyPrivate, AnomalyCGNAT and AnomalyBogon are private, carrier
+	// grade NAT and other bogon addresses replying after a public one,
+	// which are not routed on the Internet.
+	AnomalyPrivate = "private"
+	AnomalyCGNAT   = "cgnat"
+	AnomalyBogon   = "bogon"
+	// AnomalyTTLJump is a change of the length of the return path, as
+	// told by the TTL replies are received with, much larger than the
+	// change of the length of the forward one, like past MPLS tunnels or
+	// asymmetric routes.
+	AnomalyTTLJump = "ttl-jump"
+	// AnomalyShorterPath is a destination reached at a lower hop than in
+	// a previous trace, like when replied to by a transparent proxy.
+	AnomalyShorterPath = "shorter-path"
+	// AnomalyRTTStep is an increase of the RTT at a hop persisting on all
+	// the hops past it, added by the link before the hop.
+	AnomalyRTTStep = "rtt-step"
+)
+
+const (
+	// ttlJump is the number of hops the return path may change by in
+	// addition to the forward one before it is reported.
+	ttlJump = 5
+	// rttStep is the increase of the RTT reported when persisting.
+	rttStep = 20 * time.Millisecond
+)
+
+// Anomaly is a routing anomaly found at a hop.
+type Anomaly struct {
+	// Kind is one of the Anomaly constants.
+	Kind string
+	Hop  int
+	IP   net.IP `json:",omitempty"`
+	// Previous is the hop the anomaly is relative to: the first one IP
+	// replied at for loops, the previous hop replying for TTL jumps and
+	// RTT steps, and the hop the destination was reached at in the
+	// previous trace for shorter paths.
+	Previous int `json:",omitempty"`
+	// Jump is the change of the length of the return path beyond the
+	// forward one for TTL jumps.
+	Jump int `json:",omitempty"`
+	// RTT is the increase of the RTT for RTT steps.
+	RTT time.Duration `json:",omitempty"`
+}
+
+func (a Anomaly) String() string {
+	at := fmt.Sprintf("hop %d", a.Hop)
+	if a.IP != nil {
+		at = fmt.Sprintf("hop %d (%s)", a.Hop, a.IP)
+	}
+	switch a.Kind {
+	case AnomalyLoop:
+		return fmt.Sprintf("loop at %s, seen at hop %d", at, a.Previous)
+	case AnomalyPrivate, AnomalyCGNAT, AnomalyBogon:
+		return fmt.Sprintf("%s address at %s after a public one", a.Kind, at)
+	case AnomalyTTLJump:
+		return fmt.Sprintf("return path %+d hops at %s since hop %d", a.Jump, at, a.Previous)
+	case AnomalyShorterPath:
+		return fmt.Sprintf("destination reached at %s, at hop %d previously", at, a.Previous)
+	case AnomalyRTTStep:
+		return fmt.Sprintf("RTT up %s at %s since hop %d, persisting downstream", roundRTT(a.RTT), at, a.Previous)
+	}
+	return fmt.Sprintf("%s at %s", a.Kind, at)
+}
+
+// Anomalies returns the routing anomalies found on the hops of a trace to
+// dest. previous holds the hops of a previous trace to dest, compared with
+// if not nil.
+func Anomalies(hops []Hop, dest net.IP, previous []Hop) []Anomaly {
+	var anomalies []Anomaly
+	anomalies = append(anomalies, loops(hops)...)
+	anomalies = append(anomalies, nonPublic(hops)...)
+	anomalies = append(anomalies, ttlJumps(hops)...)
+	if a := shorterPath(hops, dest, previous); a != nil {
+		anomalies = append(anomalies, *a)
+	}
+	anomalies = append(anomalies, rttSteps(hops)...)
+	return anomalies
+}
+
+// loops returns the addresses replying at non-adjacent hops, the same router
+// replying at two consecutive ones when it does not decrement the TTL.
+func loops(hops []Hop) []Anomaly {
+	var anomalies []Anomaly
+	// first and last are the first and last hops each address replied at.
+	first, last := map[string]int{}, map[string]int{}
+	reported := map[string]bool{}
+	for _, h := range hops {
+		for _, ip := range h.IPs() {
+			k := ip.String()
+			if _, found := first[k]; !found {
+				first[k] = h.Seq
+			} else if h.Seq > last[k]+1 && !reported[k] {
+				reported[k] = true
+				anomalies = append(anomalies, Anomaly{Kind: AnomalyLoop, Hop: h.Seq, IP: ip, Previous: first[k]})
+			}
+			last[k] = h.Seq
+		}
+	}
+	return anomalies
+}
+
+// nonPublic returns the addresses not routed on the Internet replying after
+// the first public one.
+func nonPublic(hops []Hop) []Anomaly {
+	var anomalies []Anomaly
+	public := false
+	for _, h := range hops {
+		for _, ip := range h.IPs() {
+			kind := addressKind(ip)
+			if kind == "" {
+				public = true
+			} else if public {
+				anomalies = append(anomalies, Anomaly{Kind: kind, Hop: h.Seq, IP: ip})
+			}
+		}
+	}
+	return anomalies
+}
+
+// nonPublicPrefix is a prefix not routed on the Internet with the Anomaly
+// kind it is reported as.
+type nonPublicPrefix struct {
+	n    *net.IPNet
+	kind string
+}
+
+var nonPublicPrefixes = []nonPublicPrefix{
+	{mustParseCIDR("10.0.0.0/8"), AnomalyPrivate},
+	{mustParseCIDR("172.16.0.0/12"), AnomalyPrivate},
+	{mustParseCIDR("192.168.0.0/16"), AnomalyPrivate},
+	{mustParseCIDR("fc00::/7"), AnomalyPrivate},
+	{mustParseCIDR("100.64.0.0/10"), AnomalyCGNAT},
+	{mustParseCIDR("0.0.0.0/8"), AnomalyBogon},
+	{mustParseCIDR("127.0.0.0/8"), AnomalyBogon},
+	{mustParseCIDR("169.254.0.0/16"), AnomalyBogon},
+	{mustParseCIDR("192.0.0.0/24"), AnomalyBogon},
+	{mustParseCIDR("192.0.2.0/24"), AnomalyBogon},
+	{mustParseCIDR("198.18.0.0/15"), AnomalyBogon},
+	{mustParseCIDR("198.51.100.0/24"), AnomalyBogon},
+	{mustParseCIDR("203.0.113.0/24"), AnomalyBogon},
+	// Multicast and reserved.
+	{mustParseCIDR("224.0.0.0/3"), AnomalyBogon},
+	{mustParseCIDR("::/8"), AnomalyBogon},
+	{mustParseCIDR("100::/64"), AnomalyBogon},
+	{mustParseCIDR("2001:db8::/32"), AnomalyBogon},
+	{mustParseCIDR("fe80::/10"), AnomalyBogon},
+	{mustParseCIDR("ff00::/8"), AnomalyBogon},
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// addressKind returns the Anomaly kind of ip if it is not routed on the
+// Internet, an empty string otherwise.
+func addressKind(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.n.Contains(ip) {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+// returnLength estimates the length of the return path of a reply received
+// with ttl, assuming it was sent with the lowest usual initial TTL above.
+func returnLength(ttl int) int {
+	for _, initial := range []int{64, 128, 255} {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return 0
+}
+
+// ttlJumps returns the hops whose return path is much longer or shorter than
+// the one of the previous hop replying, compared with the forward paths.
+func ttlJumps(hops []Hop) []Anomaly {
+	var anomalies []Anomaly
+	prev, prevLength := 0, 0
+	for _, h := range hops {
+		var ip net.IP
+		length := -1
+		for _, info := range h.Info {
+			if info.Reply != nil && info.Reply.TTL > 0 {
+				ip, length = info.IP, returnLength(info.Reply.TTL)
+				break
+			}
+		}
+		if length < 0 {
+			continue
+		}
+		if prev > 0 {
+			jump := length - prevLength - (h.Seq - prev)
+			if jump > ttlJump || jump < -ttlJump {
+				anomalies = append(anomalies, Anomaly{Kind: AnomalyTTLJump, Hop: h.Seq, IP: ip, Previous: prev, Jump: jump})
+			}
+		}
+		prev, prevLength = h.Seq, length
+	}
+	return anomalies
+}
+
+// destinationHop returns the first hop dest replied at, nil if none.
+func destinationHop(hops []Hop, dest net.IP) *Hop {
+	for i, h := range hops {
+		for _, info := range h.Info {
+			if dest.Equal(info.IP) {
+				return &hops[i]
+			}
+		}
+	}
+	return nil
+}
+
+// shorterPath returns an anomaly if dest is reached at a lower hop than in
+// the previous trace.
+func shorterPath(hops []Hop, dest net.IP, previous []Hop) *Anomaly {
+	h, p := destinationHop(hops, dest), destinationHop(previous, dest)
+	if h == nil || p == nil || h.Seq >= p.Seq {
+		return nil
+	}
+	return &Anomaly{Kind: AnomalyShorterPath, Hop: h.Seq, IP: dest, Previous: p.Seq}
+}
+
+// rttSteps returns the hops where the lowest median RTT of the hops from
+// them on increases, an increase at a single hop being left to its control
+// plane.
+func rttSteps(hops []Hop) []Anomaly {
+	// floors holds the lowest median RTT of the hops from each one on, -1
+	// for hops not replying.
+	floors := make([]time.Duration, len(hops))
+	floor := time.Duration(-1)
+	for i := len(hops) - 1; i >= 0; i-- {
+		floors[i] = -1
+		if s := hops[i].Stats(); s.Received > 0 {
+			if floor < 0 || s.Median < floor {
+				floor = s.Median
+			}
+			floors[i] = floor
+		}
+	}
+	var anomalies []Anomaly
+	prev := -1
+	for i, h := range hops {
+		if floors[i] < 0 {
+			continue
+		}
+		if prev >= 0 && floors[i]-floors[prev] > rttStep {
+			a := Anomaly{Kind: AnomalyRTTStep, Hop: h.Seq, Previous: hops[prev].Seq, RTT: floors[i] - floors[prev]}
+			if ips := h.IPs(); len(ips) > 0 {
+				a.IP = ips[0]
+			}
+			anomalies = append(anomalies, a)
+		}
+		prev = i
+	}
+	return anomalies
+}
@@ -0,0 +1,116 @@
+package traceroute
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// anomalyHop returns hop seq replying from ip with the given RTT in
+// milliseconds and reply TTL, or a silent hop if ip is empty.
+func anomalyHop(seq int, ip string, rtt, ttl int) Hop {
+	if ip == "" {
+		return Hop{Seq: seq, Info: []HopInfo{{RTT: -1}}}
+	}
+	return Hop{Seq: seq, Info: []HopInfo{{
+		IP:    net.ParseIP(ip),
+		RTT:   time.Duration(rtt) * time.Millisecond,
+		Reply: &Reply{TTL: ttl},
+	}}}
+}
+
+func TestAnomalies(t *testing.T) {
+	dest := net.ParseIP("45.90.28.1")
+	path := []Hop{
+		anomalyHop(1, "192.168.1.1", 1, 64),
+		anomalyHop(2, "100.64.0.1", 5, 254),
+		anomalyHop(3, "80.10.0.1", 6, 253),
+		anomalyHop(4, "80.10.0.2", 7, 252),
+		anomalyHop(5, "45.90.28.1", 8, 59),
+	}
+	tests := []struct {
+		name     string
+		hops     []Hop
+		previous []Hop
+		want     []Anomaly
+	}{
+		{"clean", path, path, nil},
+		{"loop", []Hop{
+			path[0], path[1], path[2], path[3],
+			anomalyHop(5, "80.10.0.1", 8, 251),
+			anomalyHop(6, "80.10.0.2", 9, 250),
+			anomalyHop(7, "80.10.0.1", 10, 249),
+		}, nil, []Anomaly{
+			{Kind: AnomalyLoop, Hop: 5, IP: net.ParseIP("80.10.0.1"), Previous: 3},
+			{Kind: AnomalyLoop, Hop: 6, IP: net.ParseIP("80.10.0.2"), Previous: 4},
+		}},
+		{"same address at adjacent hops", []Hop{
+			path[0], path[1], path[2],
+			anomalyHop(4, "80.10.0.1", 6, 252),
+			path[4],
+		}, nil, nil},
+		{"non public after a public address", []Hop{
+			path[0], path[1], path[2],
+			anomalyHop(4, "10.0.0.1", 7, 252),
+			anomalyHop(5, "100.64.1.1", 7, 251),
+			anomalyHop(6, "192.0.2.1", 7, 250),
+			anomalyHop(7, "45.90.28.1", 8, 58),
+		}, nil, []Anomaly{
+			{Kind: AnomalyPrivate, Hop: 4, IP: net.ParseIP("10.0.0.1")},
+			{Kind: AnomalyCGNAT, Hop: 5, IP: net.ParseIP("100.64.1.1")},
+			{Kind: AnomalyBogon, Hop: 6, IP: net.ParseIP("192.0.2.1")},
+		}},
+		{"ttl jump", []Hop{
+			path[0], path[1], path[2],
+			anomalyHop(4, "80.10.0.2", 7, 244),
+			anomalyHop(5, "", 0, 0),
+			anomalyHop(6, "45.90.28.1", 8, 60),
+		}, nil, []Anomaly{
+			{Kind: AnomalyTTLJump, Hop: 4, IP: net.ParseIP("80.10.0.2"), Previous: 3, Jump: 8},
+			{Kind: AnomalyTTLJump, Hop: 6, IP: net.ParseIP("45.90.28.1"), Previous: 4, Jump: -9},
+		}},
+		{"destination not reached", path[:2:2], append(append([]Hop{}, path[:1]...), anomalyHop(2, "80.10.0.1", 6, 254), anomalyHop(3, "45.90.28.1", 8, 62)), nil},
+		{"destination reached earlier", append(append([]Hop{}, path[:3]...), anomalyHop(4, "45.90.28.1", 8, 60)), path, []Anomaly{
+			{Kind: AnomalyShorterPath, Hop: 4, IP: dest, Previous: 5},
+		}},
+		{"rtt step", []Hop{
+			path[0], path[1],
+			anomalyHop(3, "80.10.0.1", 90, 253),
+			anomalyHop(4, "80.10.0.2", 40, 252),
+			anomalyHop(5, "", 0, 0),
+			anomalyHop(6, "45.90.28.1", 42, 58),
+		}, nil, []Anomaly{
+			{Kind: AnomalyRTTStep, Hop: 3, IP: net.ParseIP("80.10.0.1"), Previous: 2, RTT: 35 * time.Millisecond},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Anomalies(tt.hops, dest, tt.previous); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Anomalies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressKind(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"45.90.28.0", ""},
+		{"172.31.255.255", AnomalyPrivate},
+		{"172.32.0.1", ""},
+		{"100.127.0.1", AnomalyCGNAT},
+		{"240.0.0.1", AnomalyBogon},
+		{"::ffff:10.0.0.1", AnomalyPrivate},
+		{"fd00::1", AnomalyPrivate},
+		{"2001:db8::1", AnomalyBogon},
+		{"2a07:a8c0::", ""},
+	}
+	for _, tt := range tests {
+		if got := addressKind(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("addressKind(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package traceroute
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ASInfo describes the autonomous system announcing an address.
+type ASInfo struct {
+	Number  int
+	Name    string `json:",omitempty"`
+	Country string `json:",omitempty"`
+}
+
+func (a ASInfo) String() string {
+	if a.Name == "" {
+		return fmt.Sprintf("AS%d", a.Number)
+	}
+	return fmt.Sprintf("AS%d %s", a.Number, a.Name)
+}
+
+// ASNDB maps addresses to the AS announcing them, fully offline. It is
+// loaded from a tab separated file in one of these formats, optionally gzip
+// compressed:
+//
+//	range_start  range_end  AS_number  country_code  AS_description
+//	prefix       AS_number  [AS_description]
+//
+// The first one is the format of the ip2asn databases, the second one the
+// format of prefix tables derived from MRT dumps. AS number 0 marks
+// addresses that are not routed. Lines starting with # are ignored.
+type ASNDB struct {
+	v4, v6 asnTrie
+	infos  []ASInfo
+}
+
+// OpenASNDB loads the ASNDB stored in the file at path.
+func OpenASNDB(path string) (*ASNDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadASNDB(f)
+}
+
+// LoadASNDB loads an ASNDB from r.
+func LoadASNDB(r io.Reader) (*ASNDB, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	db := &ASNDB{}
+	infos := map[ASInfo]int32{}
+	s := bufio.NewScanner(br)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		start, end, info, err := parseASNLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if info.Number == 0 {
+			continue
+		}
+		i, found := infos[info]
+		if !found {
+			i = int32(len(db.infos))
+			infos[info] = i
+			db.infos = append(db.infos, info)
+		}
+		t, bitLen := &db.v6, 128
+		if start.To4() != nil {
+			t, bitLen = &db.v4, 32
+		}
+		lo, hi := uint128FromIP(start, bitLen), uint128FromIP(end, bitLen)
+		for _, p := range rangePrefixes(lo, hi, bitLen) {
+			t.insert(p.addr, p.len, bitLen, i)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func parseASNLine(text string) (start, end net.IP, info ASInfo, err error) {
+	fields := strings.Split(text, "\t")
+	if len(fields) < 2 {
+		return nil, nil, info, fmt.Errorf("not enough fields")
+	}
+	asn := 2
+	if strings.Contains(fields[0], "/") {
+		_, n, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, nil, info, err
+		}
+		start, end = n.IP, lastIP(n)
+		asn = 1
+	} else {
+		if len(fields) < 3 {
+			return nil, nil, info, fmt.Errorf("not enough fields")
+		}
+		start, end = net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return nil, nil, info, fmt.Errorf("invalid range %s-%s", fields[0], fields[1])
+		}
+	}
+	if info.Number, err = strconv.Atoi(strings.TrimPrefix(fields[asn], "AS")); err != nil {
+		return nil, nil, info, fmt.Errorf("invalid AS number %q", fields[asn])
+	}
+	if asn == 2 && len(fields) >= 5 {
+		if fields[3] != "None" {
+			info.Country = fields[3]
+		}
+		info.Name = fields[4]
+	} else if asn == 1 && len(fields) >= 3 {
+		info.Name = fields[2]
+	}
+	if info.Name == "Not routed" {
+		info.Name = ""
+	}
+	return start, end, info, nil
+}
+
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range ip {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip
+}
+
+// Lookup returns the AS announcing ip, or nil if unknown.
+func (db *ASNDB) Lookup(ip net.IP) *ASInfo {
+	t, bitLen := &db.v6, 128
+	if ip.To4() != nil {
+		t, bitLen = &db.v4, 32
+	}
+	i := t.lookup(uint128FromIP(ip, bitLen), bitLen)
+	if i < 0 {
+		return nil
+	}
+	info := db.infos[i]
+	return &info
+}
+
+// AnnotateHops sets the AS of all the samples of hops.
+func (db *ASNDB) AnnotateHops(hops []Hop) {
+	for _, h := range hops {
+		for i := range h.Info {
+			if ip := h.Info[i].IP; ip != nil {
+				h.Info[i].AS = db.Lookup(ip)
+			}
+		}
+	}
+}
+
+// ASPath returns the ASes crossed by annotated hops, in order. Hops with no
+// known AS are skipped.
+func ASPath(hops []Hop) []ASInfo {
+	var path []ASInfo
+	for _, h := range hops {
+		for _, info := range h.Info {
+			if info.AS == nil {
+				continue
+			}
+			if len(path) == 0 || path[len(path)-1].Number != info.AS.Number {
+				path = append(path, *info.AS)
+			}
+			break
+		}
+	}
+	return path
+}
+
+// asnTrie is a binary prefix trie. Nodes are stored in a slice and reference
+// their children by index to keep large tables compact.
+type asnTrie struct {
+	nodes []asnNode
+}
+
+type asnNode struct {
+	child [2]int32
+	// info is the index of the ASInfo of the prefix ending at the node, or
+	// -1.
+	info int32
+}
+
+func (t *asnTrie) insert(addr uint128, prefixLen, bitLen int, info int32) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, asnNode{info: -1})
+	}
+	n := int32(0)
+	for i := 0; i < prefixLen; i++ {
+		b := addr.bit(bitLen - 1 - i)
+		next := t.nodes[n].child[b]
+		if next == 0 {
+			next = int32(len(t.nodes))
+			t.nodes = append(t.nodes, asnNode{info: -1})
+			t.nodes[n].child[b] = next
+		}
+		n = next
+	}
+	t.nodes[n].info = info
+}
+
+// lookup returns the info of the longest prefix matching addr, or -1.
+func (t *asnTrie) lookup(addr uint128, bitLen int) int32 {
+	if len(t.nodes) == 0 {
+		return -1
+	}
+	info := t.nodes[0].info
+	n := int32(0)
+	for i := 0; i < bitLen; i++ {
+		n = t.nodes[n].child[addr.bit(bitLen-1-i)]
+		if n == 0 {
+			break
+		}
+		if t.nodes[n].info >= 0 {
+			info = t.nodes[n].info
+		}
+	}
+	return info
+}
+
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromIP(ip net.IP, bitLen int) uint128 {
+	if bitLen == 32 {
+		ip4 := ip.To4()
+		return uint128{lo: uint64(ip4[0])<<24 | uint64(ip4[1])<<16 | uint64(ip4[2])<<8 | uint64(ip4[3])}
+	}
+	ip16 := ip.To16()
+	var u uint128
+	for i := 0; i < 8; i++ {
+		u.hi = u.hi<<8 | uint64(ip16[i])
+		u.lo = u.lo<<8 | uint64(ip16[8+i])
+	}
+	return u
+}
+
+// bit returns bit i of u, counting from the least significant one.
+func (u uint128) bit(i int) int {
+	if i >= 64 {
+		return int(u.hi>>(i-64)) & 1
+	}
+	return int(u.lo>>i) & 1
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// or returns u with its n lowest bits set.
+func (u uint128) or(n int) uint128 {
+	switch {
+	case n >= 128:
+		return uint128{^uint64(0), ^uint64(0)}
+	case n >= 64:
+		return uint128{u.hi | (1<<(n-64) - 1), ^uint64(0)}
+	default:
+		return uint128{u.hi, u.lo | (1<<n - 1)}
+	}
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) inc() (uint128, bool) {
+	lo, carry := bits.Add64(u.lo, 1, 0)
+	hi, carry := bits.Add64(u.hi, 0, carry)
+	return uint128{hi, lo}, carry != 0
+}
+
+type prefix struct {
+	addr uint128
+	len  int
+}
+
+// rangePrefixes returns the smallest list of prefixes covering the range
+// from lo to hi, inclusive.
+func rangePrefixes(lo, hi uint128, bitLen int) []prefix {
+	var prefixes []prefix
+	for !hi.less(lo) {
+		size := lo.trailingZeros()
+		if size > bitLen {
+			size = bitLen
+		}
+		for size > 0 && hi.less(lo.or(size)) {
+			size--
+		}
+		prefixes = append(prefixes, prefix{lo, bitLen - size})
+		next, overflow := lo.or(size).inc()
+		if overflow || (bitLen == 32 && next.lo>>32 != 0) {
+			break
+		}
+		lo = next
+	}
+	return prefixes
+}
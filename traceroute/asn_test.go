@@ -0,0 +1,103 @@
+package traceroute
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testIP2ASN = `# range_start	range_end	AS_number	country_code	AS_description
+1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+10.0.0.0	10.255.255.255	0	None	Not routed
+45.90.28.0	45.90.31.255	34939	GB	NEXTDNS
+80.10.0.3	80.10.2.17	3215	FR	Orange
+2a07:a8c0::	2a07:a8c1:ffff:ffff:ffff:ffff:ffff:ffff	34939	GB	NEXTDNS
+`
+
+func TestASNDBLookup(t *testing.T) {
+	db, err := LoadASNDB(strings.NewReader(testIP2ASN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"1.0.0.1", 13335},
+		{"1.0.1.1", 0},
+		{"10.1.2.3", 0},
+		{"45.90.28.0", 34939},
+		{"45.90.31.255", 34939},
+		{"45.90.32.0", 0},
+		{"80.10.0.2", 0},
+		{"80.10.0.3", 3215},
+		{"80.10.1.200", 3215},
+		{"80.10.2.17", 3215},
+		{"80.10.2.18", 0},
+		{"2a07:a8c1::53", 34939},
+		{"2a07:a8c2::", 0},
+		{"::ffff:45.90.28.1", 34939},
+	}
+	for _, tt := range tests {
+		as := db.Lookup(net.ParseIP(tt.ip))
+		got := 0
+		if as != nil {
+			got = as.Number
+		}
+		if got != tt.want {
+			t.Errorf("Lookup(%s) = AS%d, want AS%d", tt.ip, got, tt.want)
+		}
+	}
+	if as := db.Lookup(net.ParseIP("45.90.30.0")); as == nil || as.Name != "NEXTDNS" || as.Country != "GB" {
+		t.Errorf("Lookup(45.90.30.0) = %+v, want NEXTDNS in GB", as)
+	}
+}
+
+func TestASNDBPrefixTable(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("1.0.0.0/24\t13335\n1.0.0.128/25\t64500\tLONGER\n2001:db8::/32\tAS64501\n"))
+	gw.Close()
+	db, err := LoadASNDB(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]int{"1.0.0.1": 13335, "1.0.0.129": 64500, "2001:db8::1": 64501} {
+		if as := db.Lookup(net.ParseIP(ip)); as == nil || as.Number != want {
+			t.Errorf("Lookup(%s) = %v, want AS%d", ip, as, want)
+		}
+	}
+}
+
+func TestLoadASNDBError(t *testing.T) {
+	if _, err := LoadASNDB(strings.NewReader("1.0.0.0\t1.0.0.255\tx\tUS\tTEST\n")); err == nil {
+		t.Error("LoadASNDB() succeeded with an invalid AS number")
+	}
+}
+
+func TestASPath(t *testing.T) {
+	db, err := LoadASNDB(strings.NewReader(testIP2ASN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := []Hop{
+		{Seq: 1, Info: []HopInfo{{IP: net.ParseIP("10.0.0.1")}}},
+		{Seq: 2, Info: []HopInfo{{IP: net.ParseIP("80.10.0.5")}}},
+		{Seq: 3, Info: []HopInfo{{RTT: -1}, {IP: net.ParseIP("80.10.1.1")}}},
+		{Seq: 4, Info: []HopInfo{{RTT: -1}}},
+		{Seq: 5, Info: []HopInfo{{IP: net.ParseIP("45.90.28.0")}}},
+	}
+	db.AnnotateHops(hops)
+	var path []string
+	for _, as := range ASPath(hops) {
+		path = append(path, as.String())
+	}
+	if got, want := strings.Join(path, " > "), "AS3215 Orange > AS34939 NEXTDNS"; got != want {
+		t.Errorf("ASPath() = %q, want %q", got, want)
+	}
+	if got, want := hops[1].String(), "  2      80.10.0.5 [AS3215]    0ms"; got != want {
+		t.Errorf("hop 2 String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// binding pins sockets to a local address and a network interface, either of
+// which may be unset.
+type binding struct {
+	src   net.IP
+	iface string
+}
+
+// forFamily returns the binding of sockets of the given family. Where
+// sockets cannot be bound to an interface, the address of the interface is
+// used as source instead.
+func (b binding) forFamily(family int) (binding, error) {
+	if b.src != nil && traceFamily(b.src) != family {
+		return b, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("source %s for family %d", b.src, family)}
+	}
+	if b.iface != "" && !canBindToDevice {
+		if b.src == nil {
+			src, err := interfaceAddr(b.iface, family)
+			if err != nil {
+				return b, err
+			}
+			b.src = src
+		}
+		b.iface = ""
+	}
+	return b, nil
+}
+
+// control binds sockets to the interface, if any, before they are bound to
+// their address.
+func (b binding) control(network, address string, c syscall.RawConn) error {
+	if b.iface == "" {
+		return nil
+	}
+	return bindToDevice(c, b.iface)
+}
+
+// listenPacket is net.ListenPacket for sockets bound to b. UDP sockets are
+// bound to an ephemeral port.
+func (b binding) listenPacket(network string) (net.PacketConn, error) {
+	addr := ""
+	if b.src != nil {
+		addr = b.src.String()
+	}
+	if strings.HasPrefix(network, "udp") {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	lc := net.ListenConfig{Control: b.control}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+// interfaceAddr returns the first global unicast address of the given
+// family on the named interface.
+func interfaceAddr(name string, family int) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, socketError(fmt.Sprintf("interface %s", name), err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, socketError(fmt.Sprintf("interface %s", name), err)
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && traceFamily(n.IP) == family && n.IP.IsGlobalUnicast() {
+			return n.IP, nil
+		}
+	}
+	return nil, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("no IPv%d address on interface %s", family, name)}
+}
+
+// dialer returns a net.Dialer for connections of the given network bound to
+// b, the local address having to match the network.
+func (b binding) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Control: b.control}
+	if b.src == nil {
+		return d
+	}
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		d.LocalAddr = &net.TCPAddr{IP: b.src}
+	case strings.HasPrefix(network, "udp"):
+		d.LocalAddr = &net.UDPAddr{IP: b.src}
+	case strings.HasPrefix(network, "ip"):
+		d.LocalAddr = &net.IPAddr{IP: b.src}
+	}
+	return d
+}
+
+// A Dialer dials connections bound to a source address and an interface,
+// like the probes of a Tracer with the same Source and Interface. The zero
+// value dials unbound connections.
+type Dialer struct {
+	b binding
+}
+
+// NewDialer returns a Dialer whose connections are bound to source and
+// iface, either of which may be unset. Where sockets cannot be bound to an
+// interface, its IPv4 address, or IPv6 address if none, is used as source
+// instead.
+func NewDialer(source net.IP, iface string) (*Dialer, error) {
+	b := binding{src: source, iface: iface}
+	if iface != "" && !canBindToDevice {
+		if source == nil {
+			var err error
+			if b.src, err = interfaceAddr(iface, 4); err != nil {
+				if b.src, err = interfaceAddr(iface, 6); err != nil {
+					return nil, err
+				}
+			}
+		}
+		b.iface = ""
+	}
+	return &Dialer{b: b}, nil
+}
+
+// Dial connects to address on the named network, like net.Dial.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the named network using ctx, like
+// net.Dialer.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.b.dialer(network).DialContext(ctx, network, address)
+}
@@ -0,0 +1,26 @@
+package traceroute
+
+import (
+	"os"
+	"syscall"
+)
+
+// canBindToDevice is true where sockets can be bound to an interface.
+const canBindToDevice = true
+
+// bindToDevice binds the socket to the named interface with SO_BINDTODEVICE,
+// so that its packets are only sent and received on it whatever the routing
+// table says.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = bindToDeviceFD(int(fd), iface)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func bindToDeviceFD(fd int, iface string) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package traceroute
+
+import "syscall"
+
+// canBindToDevice is true where sockets can be bound to an interface.
+const canBindToDevice = false
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return &Error{Kind: ErrUnsupported, Op: "binding to an interface"}
+}
@@ -0,0 +1,56 @@
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBindingForFamily(t *testing.T) {
+	b := binding{src: net.IPv4(192, 0, 2, 1)}
+	if _, err := b.forFamily(6); !errors.Is(err, ErrUnsupportedFamily) {
+		t.Errorf("forFamily(6) error = %v, want ErrUnsupportedFamily", err)
+	}
+	got, err := b.forFamily(4)
+	if err != nil || !got.src.Equal(b.src) {
+		t.Errorf("forFamily(4) = %+v, %v", got, err)
+	}
+	if _, err := (binding{iface: "nonexistent0"}).forFamily(4); canBindToDevice == (err != nil) {
+		t.Errorf("forFamily(4) error = %v for a missing interface", err)
+	}
+}
+
+func TestSourceAddrBinding(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	src, err := sourceAddr(4, net.IPv4(127, 0, 0, 2), binding{src: lo})
+	if err != nil {
+		t.Skip(err)
+	}
+	if !src.Equal(lo) {
+		t.Errorf("sourceAddr() = %v, want %v", src, lo)
+	}
+}
+
+func TestDialerNetworks(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	d, err := NewDialer(lo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	for _, network := range []string{"udp", "tcp"} {
+		c, err := d.Dial(network, l.Addr().String())
+		if err != nil {
+			t.Errorf("Dial(%s) error = %v", network, err)
+			continue
+		}
+		if host, _, _ := net.SplitHostPort(c.LocalAddr().String()); host != lo.String() {
+			t.Errorf("Dial(%s) local address = %v, want %v", network, c.LocalAddr(), lo)
+		}
+		c.Close()
+	}
+}
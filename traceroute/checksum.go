@@ -0,0 +1,30 @@
+package traceroute
+
+import "net"
+
+// pseudoHeaderSum returns the one's complement sum of the pseudo header
+// covered by TCP and UDP checksums. src and dst must both be 4 or 16 bytes
+// long.
+func pseudoHeaderSum(src, dst net.IP, proto, length int) uint32 {
+	var s uint32
+	s = checksumAdd(s, src)
+	s = checksumAdd(s, dst)
+	return s + uint32(proto) + uint32(length)
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
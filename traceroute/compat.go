@@ -1,10 +1,10 @@
 package traceroute
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -14,9 +14,15 @@ import (
 
 const (
 	protocolICMP     = 1
+	protocolTCP      = 6
+	protocolUDP      = 17
 	protocolIPv6ICMP = 58
 )
 
+// probePortRange is the number of ports cycled through by probes sent from
+// or to incrementing ports.
+const probePortRange = 1024
+
 // packetConn provides a common interface for IPv4 and IPv6 packetConn
 type packetConn interface {
 	io.Closer
@@ -26,8 +32,51 @@ type packetConn interface {
 	SetHopLimit(hoplim int) error
 }
 
+// ttlReader is implemented by packetConns able to report the TTL or hop
+// limit packets are received with. It is zero when unknown.
+type ttlReader interface {
+	readTTL(b []byte) (n int, src net.Addr, ttl int, err error)
+}
+
+// stampedReader is implemented by packetConns able to report the time
+// packets are received at by the kernel, along with their TTL. The time is
+// zero when unknown.
+type stampedReader interface {
+	readStamped(b []byte) (n int, src net.Addr, ttl int, at time.Time, err error)
+}
+
+// timedWriter is implemented by packetConns delaying writes, which take the
+// send time of packets themselves.
+type timedWriter interface {
+	writeTimed(b []byte, dst net.Addr) (time.Time, error)
+}
+
+// writeTimed writes b to dst on conn and returns the time it was sent at,
+// taken right before the system call.
+func writeTimed(conn packetConn, b []byte, dst net.Addr) (time.Time, error) {
+	if w, ok := conn.(timedWriter); ok {
+		return w.writeTimed(b, dst)
+	}
+	start := time.Now()
+	_, err := conn.Write(b, dst)
+	return start, err
+}
+
+// tosSetter is implemented by packetConns able to set the TOS or traffic
+// class of the packets they send.
+type tosSetter interface {
+	setTOS(tos int) error
+}
+
+// syscallConner is implemented by packetConns giving access to their
+// socket, to set options x/net does not cover.
+type syscallConner interface {
+	SyscallConn() (syscall.RawConn, error)
+}
+
 type packetConn4 struct {
 	*ipv4.PacketConn
+	c net.PacketConn
 }
 
 func (p packetConn4) Write(b []byte, dst net.Addr) (int, error) {
@@ -37,51 +86,186 @@ func (p packetConn4) Read(b []byte) (n int, src net.Addr, err error) {
 	n, _, src, err = p.PacketConn.ReadFrom(b)
 	return
 }
+func (p packetConn4) readTTL(b []byte) (n int, src net.Addr, ttl int, err error) {
+	n, cm, src, err := p.PacketConn.ReadFrom(b)
+	if cm != nil {
+		ttl = cm.TTL
+	}
+	return n, src, ttl, err
+}
 func (p packetConn4) SetHopLimit(hoplim int) error {
 	return p.PacketConn.SetTTL(hoplim)
 }
+func (p packetConn4) SyscallConn() (syscall.RawConn, error) {
+	return p.c.(syscall.Conn).SyscallConn()
+}
+func (p packetConn4) setTOS(tos int) error {
+	return p.PacketConn.SetTOS(tos)
+}
 
 type packetConn6 struct {
 	*ipv6.PacketConn
+	c net.PacketConn
+	// oob is the control message sent with each packet, if any.
+	oob []byte
 }
 
 func (p packetConn6) Write(b []byte, dst net.Addr) (int, error) {
+	if p.oob != nil {
+		return writeMsg(p.c, b, p.oob, dst)
+	}
 	return p.PacketConn.WriteTo(b, nil, dst)
 }
 func (p packetConn6) Read(b []byte) (n int, src net.Addr, err error) {
 	n, _, src, err = p.PacketConn.ReadFrom(b)
 	return
 }
-func newPacketConn(family int) (conn packetConn, err error) {
+func (p packetConn6) readTTL(b []byte) (n int, src net.Addr, ttl int, err error) {
+	n, cm, src, err := p.PacketConn.ReadFrom(b)
+	if cm != nil {
+		ttl = cm.HopLimit
+	}
+	return n, src, ttl, err
+}
+func (p packetConn6) SyscallConn() (syscall.RawConn, error) {
+	return p.c.(syscall.Conn).SyscallConn()
+}
+func (p packetConn6) setTOS(tos int) error {
+	return p.PacketConn.SetTrafficClass(tos)
+}
+
+// writeMsg writes b to dst on c along with the control message oob, which
+// x/net cannot marshal.
+func writeMsg(c net.PacketConn, b, oob []byte, dst net.Addr) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	switch c := c.(type) {
+	case *net.IPConn:
+		addr, _ := dst.(*net.IPAddr)
+		n, _, err = c.WriteMsgIP(b, oob, addr)
+	case *net.UDPConn:
+		addr, _ := dst.(*net.UDPAddr)
+		n, _, err = c.WriteMsgUDP(b, oob, addr)
+	default:
+		return 0, fmt.Errorf("cannot send control messages on %T", c)
+	}
+	return n, err
+}
+
+// newPacketConn opens a raw ICMP socket bound to b.
+func newPacketConn(family int, b binding) (conn packetConn, err error) {
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("newPacketConn(%d): %w", family, err)
+			err = socketError(fmt.Sprintf("newPacketConn(%d)", family), err)
 		}
 	}()
 	switch family {
 	case 4:
-		c, err := icmp.ListenPacket("ip4:icmp", "")
+		c, err := b.listenPacket("ip4:icmp")
 		if err != nil {
 			return nil, err
 		}
-		p := c.IPv4PacketConn()
+		enableTimestamps(c.(syscall.Conn))
+		p := ipv4.NewPacketConn(c)
 		if err := p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+			c.Close()
 			return nil, err
 		}
-		return packetConn4{p}, nil
+		return packetConn4{p, c}, nil
 	case 6:
-		c, err := icmp.ListenPacket("ip6:ipv6-icmp", "")
+		c, err := b.listenPacket("ip6:ipv6-icmp")
 		if err != nil {
 			return nil, err
 		}
-		p := c.IPv6PacketConn()
+		enableTimestamps(c.(syscall.Conn))
+		p := ipv6.NewPacketConn(c)
 		if err := p.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return packetConn6{PacketConn: p, c: c}, nil
+	default:
+		return nil, ErrUnsupportedFamily
+	}
+}
+
+// newUDPConn opens an unconnected UDP socket used to send UDP probes. ICMP
+// errors triggered by those probes are received on the ICMP packetConn.
+func newUDPConn(family int, b binding) (conn packetConn, port int, err error) {
+	defer func() {
+		if err != nil {
+			err = socketError(fmt.Sprintf("newUDPConn(%d)", family), err)
+		}
+	}()
+	switch family {
+	case 4:
+		c, err := b.listenPacket("udp4")
+		if err != nil {
+			return nil, 0, err
+		}
+		return packetConn4{ipv4.NewPacketConn(c), c}, c.LocalAddr().(*net.UDPAddr).Port, nil
+	case 6:
+		c, err := b.listenPacket("udp6")
+		if err != nil {
+			return nil, 0, err
+		}
+		return packetConn6{PacketConn: ipv6.NewPacketConn(c), c: c}, c.LocalAddr().(*net.UDPAddr).Port, nil
+	default:
+		return nil, 0, ErrUnsupportedFamily
+	}
+}
+
+// newTCPConn opens a raw TCP socket used to send TCP SYN probes and receive
+// the SYN-ACK or RST segments sent back by the destination. Note that BSD
+// systems do not deliver TCP segments to raw sockets, the destination is
+// thus never detected on those.
+func newTCPConn(family int, b binding) (conn packetConn, err error) {
+	defer func() {
+		if err != nil {
+			err = socketError(fmt.Sprintf("newTCPConn(%d)", family), err)
+		}
+	}()
+	switch family {
+	case 4:
+		c, err := b.listenPacket("ip4:tcp")
+		if err != nil {
 			return nil, err
 		}
-		return packetConn6{p}, nil
+		enableTimestamps(c.(syscall.Conn))
+		p := ipv4.NewPacketConn(c)
+		// Best effort, the TTL of replies is only informative.
+		_ = p.SetControlMessage(ipv4.FlagTTL, true)
+		return packetConn4{p, c}, nil
+	case 6:
+		c, err := b.listenPacket("ip6:tcp")
+		if err != nil {
+			return nil, err
+		}
+		enableTimestamps(c.(syscall.Conn))
+		p := ipv6.NewPacketConn(c)
+		// Best effort, the hop limit of replies is only informative.
+		_ = p.SetControlMessage(ipv6.FlagHopLimit, true)
+		return packetConn6{PacketConn: p, c: c}, nil
 	default:
-		return nil, errors.New("unsupported network")
+		return nil, ErrUnsupportedFamily
+	}
+}
+
+// sourceAddr returns the local address the system would use to reach dest
+// from sockets bound to b. No packet is sent.
+func sourceAddr(family int, dest net.IP, b binding) (net.IP, error) {
+	network := "udp4"
+	if family == 6 {
+		network = "udp6"
 	}
+	c, err := b.dialer(network).Dial(network, (&net.UDPAddr{IP: dest, Port: DefaultUDPPort}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
 }
 
 func icmpProto(family int) int {
@@ -106,25 +290,42 @@ func icmpEchoType(family int) icmp.Type {
 	}
 }
 
-func ipPayloadOffset(family int, b []byte) (int, error) {
-	var l int
+// ipPayloadOffset returns the offset of the payload in the IP packet b, the
+// protocol it carries and its TTL or hop limit.
+func ipPayloadOffset(family int, b []byte) (l, proto, ttl int, err error) {
 	switch family {
 	case 4:
 		h, err := ipv4.ParseHeader(b)
 		if err != nil {
-			return -1, err
+			return -1, 0, 0, err
 		}
-		l = h.Len
+		l, proto, ttl = h.Len, h.Protocol, h.TTL
 	case 6:
 		h, err := ipv6.ParseHeader(b)
 		if err != nil {
-			return -1, err
+			return -1, 0, 0, err
 		}
-		l = len(b) - h.PayloadLen
+		// Not len(b)-h.PayloadLen, quoted packets are often truncated.
+		l, proto, ttl = ipv6.HeaderLen, h.NextHeader, h.HopLimit
 	default:
 		panic("invalid family")
 	}
-	return l, nil
+	return l, proto, ttl, nil
+}
+
+// icmpType returns the ICMP type numbered typ in the given family.
+func icmpType(family, typ int) icmp.Type {
+	if family == 6 {
+		return ipv6.ICMPType(typ)
+	}
+	return ipv4.ICMPType(typ)
+}
+
+func icmpProtoName(family int) string {
+	if family == 6 {
+		return "icmpv6"
+	}
+	return "icmp"
 }
 
 func isICMPEchoReply(t icmp.Type) bool {
@@ -138,3 +339,9 @@ func isICMPTimeExceeded(t icmp.Type) bool {
 func isICMPDestinationUnreachable(t icmp.Type) bool {
 	return t == ipv4.ICMPTypeDestinationUnreachable || t == ipv6.ICMPTypeDestinationUnreachable
 }
+
+// isICMPTooBig returns true for Fragmentation Needed and Packet Too Big
+// errors, which carry the MTU of the next hop.
+func isICMPTooBig(t icmp.Type, code int) bool {
+	return t == ipv4.ICMPTypeDestinationUnreachable && code == 4 || t == ipv6.ICMPTypePacketTooBig
+}
@@ -0,0 +1,335 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+	// sockExtendedErrLen is the size of struct sock_extended_err.
+	sockExtendedErrLen = 16
+)
+
+// dgramConn is a packetConn on top of a Linux ICMP datagram socket ("ping
+// socket"), which does not require privileges when the group of the process
+// is within the net.ipv4.ping_group_range sysctl. The kernel only delivers
+// the Echo Replies to the socket, rewriting the Echo ID of requests to the
+// one it assigned to the socket. ICMP errors triggered by the requests are
+// queued on the socket error queue with IP_RECVERR and rebuilt by Read as a
+// raw socket would have received them.
+type dgramConn struct {
+	family int
+	c      *net.UDPConn
+	raw    syscall.RawConn
+	id     int
+	// oob is the control message sent with each request, if any.
+	oob []byte
+}
+
+func newDgramConn(family int, b binding) (conn packetConn, err error) {
+	defer func() {
+		if err != nil {
+			err = socketError(fmt.Sprintf("newDgramConn(%d)", family), err)
+		}
+	}()
+	var (
+		domain, proto, level, opt int
+		sa                        syscall.Sockaddr
+	)
+	switch family {
+	case 4:
+		domain, proto, level, opt = syscall.AF_INET, protocolICMP, syscall.IPPROTO_IP, syscall.IP_RECVERR
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], b.src.To4())
+		sa = sa4
+	case 6:
+		domain, proto, level, opt = syscall.AF_INET6, protocolIPv6ICMP, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], b.src.To16())
+		sa = sa6
+	default:
+		return nil, ErrUnsupportedFamily
+	}
+	s, err := syscall.Socket(domain, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(s, level, opt, 1); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if b.iface != "" {
+		if err := bindToDeviceFD(s, b.iface); err != nil {
+			syscall.Close(s)
+			return nil, err
+		}
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "icmp")
+	pc, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("unexpected connection type %T", pc)
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	enableTimestamps(c)
+	// Best effort, the TTL of replies is only informative.
+	if family == 4 {
+		_ = ipv4.NewPacketConn(c).SetControlMessage(ipv4.FlagTTL, true)
+	} else {
+		_ = ipv6.NewPacketConn(c).SetControlMessage(ipv6.FlagHopLimit, true)
+	}
+	return &dgramConn{
+		family: family,
+		c:      c,
+		raw:    raw,
+		id:     c.LocalAddr().(*net.UDPAddr).Port,
+	}, nil
+}
+
+// echoID returns the Echo ID the kernel puts in requests sent on the socket.
+func (c *dgramConn) echoID() int {
+	return c.id
+}
+
+func (c *dgramConn) SyscallConn() (syscall.RawConn, error) {
+	return c.raw, nil
+}
+
+func (c *dgramConn) Close() error {
+	return c.c.Close()
+}
+
+func (c *dgramConn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+func (c *dgramConn) SetHopLimit(hoplim int) error {
+	if c.family == 4 {
+		return ipv4.NewPacketConn(c.c).SetTTL(hoplim)
+	}
+	return ipv6.NewPacketConn(c.c).SetHopLimit(hoplim)
+}
+
+func (c *dgramConn) setTOS(tos int) error {
+	if c.family == 4 {
+		return ipv4.NewPacketConn(c.c).SetTOS(tos)
+	}
+	return ipv6.NewPacketConn(c.c).SetTrafficClass(tos)
+}
+
+func (c *dgramConn) Write(b []byte, dst net.Addr) (n int, err error) {
+	addr := &net.UDPAddr{IP: netAddrToIP(dst)}
+	// A pending socket error set by an ICMP error fails the next write and
+	// is cleared by doing so. The error itself is left in the error queue.
+	for i := 0; i < 2; i++ {
+		if c.oob != nil {
+			n, _, err = c.c.WriteMsgUDP(b, c.oob, addr)
+		} else {
+			n, err = c.c.WriteTo(b, addr)
+		}
+		if err == nil || !isPendingICMPError(err) {
+			break
+		}
+	}
+	return n, err
+}
+
+// Read returns the next Echo Reply or ICMP error. Errors are read first so
+// that the pending socket error they set does not fail the regular read.
+func (c *dgramConn) Read(b []byte) (n int, src net.Addr, err error) {
+	n, src, _, err = c.readTTL(b)
+	return n, src, err
+}
+
+func (c *dgramConn) readTTL(b []byte) (n int, src net.Addr, ttl int, err error) {
+	n, src, ttl, _, err = c.readStamped(b)
+	return n, src, ttl, err
+}
+
+func (c *dgramConn) readStamped(b []byte) (n int, src net.Addr, ttl int, at time.Time, err error) {
+	var rerr error
+	oob := make([]byte, 512)
+	err = c.raw.Read(func(fd uintptr) bool {
+		for {
+			n, src, ttl, at, rerr = c.readErrQueue(int(fd), b)
+			if rerr != syscall.EAGAIN {
+				return true
+			}
+			var oobn int
+			var from syscall.Sockaddr
+			n, oobn, _, from, rerr = syscall.Recvmsg(int(fd), b, oob, syscall.MSG_DONTWAIT)
+			switch rerr {
+			case nil:
+				src = &net.IPAddr{IP: sockaddrIP(from)}
+				ttl = parseTTL(c.family, oob[:oobn])
+				at = parseTimestamp(oob[:oobn])
+				return true
+			case syscall.EAGAIN:
+				return false
+			case syscall.EINTR:
+				continue
+			}
+			if isPendingICMPError(rerr) {
+				// Reported by an ICMP error not yet read from the error
+				// queue.
+				continue
+			}
+			rerr = os.NewSyscallError("recvmsg", rerr)
+			return true
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	return n, src, ttl, at, err
+}
+
+// readErrQueue reads an ICMP error from the socket error queue and writes it
+// in b as received by a raw socket, returning the TTL and time it was
+// received with. It returns EAGAIN if the queue is empty.
+func (c *dgramConn) readErrQueue(fd int, b []byte) (int, net.Addr, int, time.Time, error) {
+	quoted := make([]byte, len(b))
+	oob := make([]byte, 512)
+	for {
+		n, oobn, _, to, err := syscall.Recvmsg(fd, quoted, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, nil, 0, time.Time{}, err
+		}
+		typ, code, info, offender, ok := parseRecvErr(c.family, oob[:oobn])
+		if !ok {
+			// Not an ICMP error, e.g. a local error.
+			continue
+		}
+		p := icmpErrorPacket(c.family, typ, code, info, sockaddrIP(to), quoted[:n])
+		return copy(b, p), &net.IPAddr{IP: offender}, parseTTL(c.family, oob[:oobn]), parseTimestamp(oob[:oobn]), nil
+	}
+}
+
+// parseTTL returns the TTL or hop limit found in the control messages oob,
+// or zero.
+func parseTTL(family int, oob []byte) int {
+	if family == 4 {
+		var cm ipv4.ControlMessage
+		if cm.Parse(oob) != nil {
+			return 0
+		}
+		return cm.TTL
+	}
+	var cm ipv6.ControlMessage
+	if cm.Parse(oob) != nil {
+		return 0
+	}
+	return cm.HopLimit
+}
+
+// parseRecvErr extracts the ICMP type, code and info (the MTU of Too Big
+// errors) and the address of the node which sent an ICMP error from the
+// IP_RECVERR or IPV6_RECVERR control message.
+func parseRecvErr(family int, oob []byte) (typ, code byte, info uint32, offender net.IP, ok bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, 0, nil, false
+	}
+	for _, m := range msgs {
+		d := m.Data
+		switch {
+		case family == 4 && m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR:
+			if len(d) < sockExtendedErrLen+8 || d[4] != soEEOriginICMP {
+				return 0, 0, 0, nil, false
+			}
+			// Followed by a sockaddr_in.
+			offender = net.IP(append([]byte(nil), d[sockExtendedErrLen+4:sockExtendedErrLen+8]...))
+		case family == 6 && m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR:
+			if len(d) < sockExtendedErrLen+24 || d[4] != soEEOriginICMP6 {
+				return 0, 0, 0, nil, false
+			}
+			// Followed by a sockaddr_in6.
+			offender = net.IP(append([]byte(nil), d[sockExtendedErrLen+8:sockExtendedErrLen+24]...))
+		default:
+			continue
+		}
+		// ee_info is in host byte order.
+		return d[5], d[6], *(*uint32)(unsafe.Pointer(&d[8])), offender, true
+	}
+	return 0, 0, 0, nil, false
+}
+
+// icmpErrorPacket builds an ICMP error message of the given type and code
+// quoting payload, the ICMP header and data of a request sent to dst, behind
+// a minimal IP header. As the quoted TTL is unknown, it is left to zero. The
+// MTU of Too Big errors is set to info.
+func icmpErrorPacket(family int, typ, code byte, info uint32, dst net.IP, payload []byte) []byte {
+	var ip []byte
+	if family == 4 {
+		h := ipv4.Header{
+			Version:  ipv4.Version,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + len(payload),
+			Protocol: protocolICMP,
+			Src:      net.IPv4zero,
+			Dst:      dst.To4(),
+		}
+		ip, _ = h.Marshal()
+	} else {
+		ip = make([]byte, ipv6.HeaderLen)
+		ip[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(payload)))
+		ip[6] = protocolIPv6ICMP
+		copy(ip[24:40], dst.To16())
+	}
+	b := make([]byte, 8, 8+len(ip)+len(payload))
+	b[0], b[1] = typ, code
+	if family == 4 && isICMPTooBig(ipv4.ICMPType(typ), int(code)) || family == 6 && isICMPTooBig(ipv6.ICMPType(typ), int(code)) {
+		binary.BigEndian.PutUint32(b[4:8], info)
+	}
+	b = append(b, ip...)
+	return append(b, payload...)
+}
+
+// isPendingICMPError returns true if err is the errno the kernel sets on the
+// socket when an ICMP error is received.
+func isPendingICMPError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.ECONNREFUSED, syscall.EPROTO, syscall.EMSGSIZE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func sockaddrIP(sa syscall.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	case *syscall.SockaddrInet6:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	}
+	return nil
+}
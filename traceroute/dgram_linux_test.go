@@ -0,0 +1,74 @@
+package traceroute
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestICMPErrorPacket(t *testing.T) {
+	tests := []struct {
+		family int
+		typ    byte
+		code   byte
+		dst    net.IP
+		last   bool
+		// mtu is the MTU expected in the reply, info being 1400.
+		mtu int
+	}{
+		{4, byte(ipv4.ICMPTypeTimeExceeded), 0, net.IPv4(203, 0, 113, 1), false, 0},
+		{4, byte(ipv4.ICMPTypeDestinationUnreachable), 0, net.IPv4(203, 0, 113, 1), true, 0},
+		{4, byte(ipv4.ICMPTypeDestinationUnreachable), 4, net.IPv4(203, 0, 113, 1), true, 1400},
+		{6, byte(ipv6.ICMPTypeTimeExceeded), 0, net.ParseIP("2001:db8::1"), false, 0},
+		{6, byte(ipv6.ICMPTypePacketTooBig), 0, net.ParseIP("2001:db8::1"), false, 1400},
+	}
+	for _, tt := range tests {
+		echo := icmp.Message{
+			Type: icmpEchoType(tt.family),
+			Body: &icmp.Echo{ID: 1234, Seq: 42, Data: make([]byte, 8)},
+		}
+		quoted, err := echo.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := icmpErrorPacket(tt.family, tt.typ, tt.code, 1400, tt.dst, quoted)
+		p, err := handleICMPPacket(b, tt.family)
+		if err != nil {
+			t.Fatalf("type %d: handleICMPPacket() error = %v", tt.typ, err)
+		}
+		if !p.Valid || p.Proto != icmpProto(tt.family) || p.ID != 1234 || p.Seq != 42 || p.Last != tt.last {
+			t.Fatalf("type %d: packet = %+v, want valid echo 1234/42 last=%v", tt.typ, p, tt.last)
+		}
+		if p.Reply.MTU != tt.mtu {
+			t.Errorf("type %d: MTU = %d, want %d", tt.typ, p.Reply.MTU, tt.mtu)
+		}
+	}
+}
+
+func TestParseRecvErr(t *testing.T) {
+	// struct sock_extended_err followed by the offender sockaddr_in.
+	ee := make([]byte, sockExtendedErrLen+16)
+	ee[4] = soEEOriginICMP
+	ee[5] = byte(ipv4.ICMPTypeTimeExceeded)
+	ee[6] = 1
+	ee[sockExtendedErrLen] = syscall.AF_INET
+	copy(ee[sockExtendedErrLen+4:], net.IPv4(192, 0, 2, 1).To4())
+	oob := controlMessage(syscall.IPPROTO_IP, syscall.IP_RECVERR, ee)
+
+	typ, code, _, offender, ok := parseRecvErr(4, oob)
+	if !ok {
+		t.Fatal("parseRecvErr() ok = false")
+	}
+	if typ != byte(ipv4.ICMPTypeTimeExceeded) || code != 1 || !offender.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("parseRecvErr() = %d, %d, %v", typ, code, offender)
+	}
+
+	ee[4] = 1 // SO_EE_ORIGIN_LOCAL
+	if _, _, _, _, ok := parseRecvErr(4, controlMessage(syscall.IPPROTO_IP, syscall.IP_RECVERR, ee)); ok {
+		t.Fatal("parseRecvErr() ok = true for a local error")
+	}
+}
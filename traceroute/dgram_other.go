@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package traceroute
+
+func newDgramConn(family int, b binding) (packetConn, error) {
+	return nil, &Error{Kind: ErrUnsupported, Op: "datagram ICMP sockets"}
+}
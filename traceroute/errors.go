@@ -0,0 +1,70 @@
+package traceroute
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Errors returned by the package wrap one of these, which can be checked for
+// with errors.Is.
+var (
+	// ErrPermission is returned when the process is not allowed to open the
+	// sockets needed to send probes.
+	ErrPermission = errors.New("permission denied")
+	// ErrUnsupportedFamily is returned when the system does not support the
+	// address family of the destination.
+	ErrUnsupportedFamily = errors.New("unsupported address family")
+	// ErrUnsupported is returned when a method or mode is not supported on
+	// this platform.
+	ErrUnsupported = errors.New("not supported")
+	// ErrSocket is returned when setting up or using a socket fails.
+	ErrSocket = errors.New("socket error")
+	// ErrParse is returned when a received packet cannot be parsed.
+	ErrParse = errors.New("cannot parse packet")
+	// ErrCanceled is returned when the context is done before the end of a
+	// trace. The context error is also wrapped.
+	ErrCanceled = errors.New("trace canceled")
+)
+
+// Error is the type of errors returned by the package.
+type Error struct {
+	// Kind is one of the Err* variables of the package.
+	Kind error
+	// Op describes the operation which failed.
+	Op string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Op + ": " + e.Kind.Error()
+	}
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// socketError returns an Error for err, returned by op while setting up or
+// using a socket.
+func socketError(op string, err error) error {
+	kind := ErrSocket
+	switch {
+	case errors.Is(err, ErrUnsupportedFamily), errors.Is(err, syscall.EAFNOSUPPORT):
+		kind = ErrUnsupportedFamily
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrPermission
+	}
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+func canceledError(err error) error {
+	return &Error{Kind: ErrCanceled, Op: "trace", Err: err}
+}
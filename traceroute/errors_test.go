@@ -0,0 +1,34 @@
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSocketError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{&net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.EPERM)}, ErrPermission},
+		{&net.OpError{Op: "listen", Net: "ip6:ipv6-icmp", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}, ErrUnsupportedFamily},
+		{ErrUnsupportedFamily, ErrUnsupportedFamily},
+		{errors.New("boom"), ErrSocket},
+	}
+	for _, tt := range tests {
+		err := socketError("newPacketConn(4)", tt.err)
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("socketError(%v) = %v, want %v", tt.err, err, tt.kind)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("socketError(%v) does not wrap the original error", tt.err)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Op != "newPacketConn(4)" {
+			t.Errorf("socketError(%v) = %#v, want *Error", tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package traceroute
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/icmp"
+)
+
+// MPLSLabel is an entry of the MPLS label stack of a probe as received by a
+// router, which the router quotes in its ICMP errors (RFC 4950).
+type MPLSLabel struct {
+	Label int
+	// TC is the traffic class.
+	TC int
+	// S is set on the bottom entry of the stack.
+	S   bool
+	TTL int
+}
+
+func (l MPLSLabel) String() string {
+	s := 0
+	if l.S {
+		s = 1
+	}
+	return fmt.Sprintf("L=%d,TC=%d,S=%d,TTL=%d", l.Label, l.TC, s, l.TTL)
+}
+
+// InterfaceInfo identifies an interface of a router replying with an ICMP
+// error (RFC 5837).
+type InterfaceInfo struct {
+	// Role is the role of the interface: incoming, sub-ip, outgoing or
+	// next-hop.
+	Role  string
+	Index int    `json:",omitempty"`
+	Name  string `json:",omitempty"`
+	IP    net.IP `json:",omitempty"`
+	MTU   int    `json:",omitempty"`
+}
+
+func (i InterfaceInfo) String() string {
+	s := []string{i.Role}
+	if i.Name != "" {
+		s = append(s, i.Name)
+	}
+	if i.Index != 0 {
+		s = append(s, fmt.Sprintf("index=%d", i.Index))
+	}
+	if i.IP != nil {
+		s = append(s, i.IP.String())
+	}
+	if i.MTU != 0 {
+		s = append(s, fmt.Sprintf("mtu=%d", i.MTU))
+	}
+	return strings.Join(s, " ")
+}
+
+var interfaceRoles = [...]string{"incoming", "sub-ip", "outgoing", "next-hop"}
+
+// parseExtensions returns the MPLS label stack and interface information
+// objects of the ICMP extensions exts.
+func parseExtensions(exts []icmp.Extension) (labels []MPLSLabel, ifaces []InterfaceInfo) {
+	for _, ext := range exts {
+		switch ext := ext.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range ext.Labels {
+				labels = append(labels, MPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+			}
+		case *icmp.InterfaceInfo:
+			i := InterfaceInfo{Role: interfaceRoles[ext.Type>>6&0x3]}
+			if ext.Interface != nil {
+				i.Index = ext.Interface.Index
+				i.Name = ext.Interface.Name
+				i.MTU = ext.Interface.MTU
+			}
+			if ext.Addr != nil {
+				i.IP = ext.Addr.IP
+			}
+			ifaces = append(ifaces, i)
+		}
+	}
+	return labels, ifaces
+}
+
+// extensionLines returns the distinct MPLS label stacks and interfaces of
+// the hop samples, formatted for Hop.String.
+func (h Hop) extensionLines() []string {
+	var lines []string
+	seen := map[string]bool{}
+	add := func(line string) {
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	for _, info := range h.Info {
+		if len(info.MPLS) > 0 {
+			s := make([]string, len(info.MPLS))
+			for i, l := range info.MPLS {
+				s[i] = l.String()
+			}
+			add("MPLS " + strings.Join(s, " "))
+		}
+		for _, i := range info.Interfaces {
+			add("interface " + i.String())
+		}
+	}
+	return lines
+}
@@ -0,0 +1,74 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Flow label management, from linux/in6.h.
+const (
+	ipv6FlowLabelMgr = 0x20
+	ipv6FlowInfo     = 0xb
+	ipv6FLActionGet  = 0
+	ipv6FLFlagCreate = 1
+	ipv6FLShareUser  = 3
+	// flowLabelReqLen is the size of struct in6_flowlabel_req.
+	flowLabelReqLen = 32
+)
+
+// setFlowLabel returns conn sending its packets with the given flow label.
+// Linux only sends labels leased by the socket, so one is leased first.
+func setFlowLabel(conn packetConn, dest net.IP, label int) (packetConn, error) {
+	sc, ok := conn.(syscallConner)
+	if !ok {
+		return nil, &Error{Kind: ErrUnsupported, Op: "flow label"}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, socketError("cannot set flow label", err)
+	}
+	req := make([]byte, flowLabelReqLen)
+	copy(req[0:16], dest.To16())
+	binary.BigEndian.PutUint32(req[16:20], uint32(label))
+	req[20] = ipv6FLActionGet
+	// Other sockets of the user may lease the same label, like the ones of
+	// a previous trace whose lease lingers.
+	req[21] = ipv6FLShareUser
+	*(*uint16)(unsafe.Pointer(&req[22])) = ipv6FLFlagCreate
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IPV6, ipv6FlowLabelMgr, string(req))
+	}); err != nil {
+		return nil, socketError("cannot set flow label", err)
+	}
+	if serr != nil {
+		return nil, socketError("cannot set flow label", os.NewSyscallError("setsockopt", serr))
+	}
+	info := make([]byte, 4)
+	binary.BigEndian.PutUint32(info, uint32(label))
+	oob := controlMessage(syscall.IPPROTO_IPV6, ipv6FlowInfo, info)
+	switch c := conn.(type) {
+	case packetConn6:
+		c.oob = oob
+		return c, nil
+	case *dgramConn:
+		c.oob = oob
+		return c, nil
+	}
+	return nil, &Error{Kind: ErrUnsupported, Op: "flow label"}
+}
+
+// controlMessage returns a control message of the given level and type
+// carrying data.
+func controlMessage(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package traceroute
+
+import "net"
+
+func setFlowLabel(conn packetConn, dest net.IP, label int) (packetConn, error) {
+	return nil, &Error{Kind: ErrUnsupported, Op: "flow label"}
+}
@@ -0,0 +1,160 @@
+package traceroute
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"time"
+)
+
+// Location is the approximate geographic location of an address.
+type Location struct {
+	City string `json:",omitempty"`
+	// Country is the ISO 3166-1 code of the country.
+	Country   string  `json:",omitempty"`
+	Latitude  float64 `json:",omitempty"`
+	Longitude float64 `json:",omitempty"`
+}
+
+func (l Location) String() string {
+	switch {
+	case l.City != "" && l.Country != "":
+		return l.City + ", " + l.Country
+	case l.City != "":
+		return l.City
+	default:
+		return l.Country
+	}
+}
+
+// hasCoordinates reports whether l holds coordinates, which country
+// databases lack.
+func (l Location) hasCoordinates() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// GeoDB maps addresses to their location, fully offline, using a MaxMind DB
+// file like GeoLite2-City or GeoLite2-Country, or any database following the
+// same layout.
+type GeoDB struct {
+	r *mmdbReader
+}
+
+// OpenGeoDB loads the MMDB file at path.
+func OpenGeoDB(path string) (*GeoDB, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMMDBReader(b)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoDB{r: r}, nil
+}
+
+// Lookup returns the location of ip, or nil if unknown.
+func (db *GeoDB) Lookup(ip net.IP) *Location {
+	v, err := db.r.lookup(ip)
+	if err != nil || v == nil {
+		return nil
+	}
+	var l Location
+	l.City, _ = mmdbPath(v, "city", "names", "en").(string)
+	if l.Country, _ = mmdbPath(v, "country", "iso_code").(string); l.Country == "" {
+		l.Country, _ = mmdbPath(v, "registered_country", "iso_code").(string)
+	}
+	l.Latitude, _ = mmdbPath(v, "location", "latitude").(float64)
+	l.Longitude, _ = mmdbPath(v, "location", "longitude").(float64)
+	if l == (Location{}) {
+		return nil
+	}
+	return &l
+}
+
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// AnnotateHops sets the Location of all the samples of hops.
+func (db *GeoDB) AnnotateHops(hops []Hop) {
+	for _, h := range hops {
+		for i := range h.Info {
+			if ip := h.Info[i].IP; ip != nil {
+				h.Info[i].Location = db.Lookup(ip)
+			}
+		}
+	}
+}
+
+const earthRadius = 6371 // km
+
+// Distance returns the great circle distance between a and b in kilometers.
+func Distance(a, b Location) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+const (
+	// fiberSpeed is the speed of light in optical fiber, in km per
+	// millisecond.
+	fiberSpeed = 200
+	// slowRTTFactor and slowRTTMargin bound the RTT expected over a
+	// distance, relative to the minimum set by fiberSpeed. The margin
+	// accounts for the access network and the processing of the probes.
+	slowRTTFactor = 3
+	slowRTTMargin = 50 * time.Millisecond
+)
+
+// GeoCheck compares the RTT to a target with the great circle distance to
+// its location.
+type GeoCheck struct {
+	Distance float64 // km
+	// MinRTT is the lowest RTT allowed by the speed of light in fiber over
+	// Distance.
+	MinRTT time.Duration
+	RTT    time.Duration
+	// Verdict is "impossible" if RTT is below MinRTT, meaning the target
+	// is not where the database puts it (typically anycast), "detour" if
+	// RTT is far above what the distance explains, and "ok" otherwise.
+	Verdict string
+}
+
+func (c GeoCheck) String() string {
+	return fmt.Sprintf("%s: %.0fkm away, RTT %s, physical minimum %s", c.Verdict, c.Distance,
+		c.RTT.Round(100*time.Microsecond), c.MinRTT.Round(100*time.Microsecond))
+}
+
+// CheckRTT checks the RTT measured from a source to a target against the
+// distance between their locations. It returns nil when either location
+// lacks coordinates or rtt is unknown.
+func CheckRTT(from, to *Location, rtt time.Duration) *GeoCheck {
+	if from == nil || to == nil || !from.hasCoordinates() || !to.hasCoordinates() || rtt <= 0 {
+		return nil
+	}
+	d := Distance(*from, *to)
+	c := &GeoCheck{
+		Distance: d,
+		MinRTT:   time.Duration(2 * d / fiberSpeed * float64(time.Millisecond)),
+		RTT:      rtt,
+		Verdict:  "ok",
+	}
+	switch {
+	case rtt < c.MinRTT:
+		c.Verdict = "impossible"
+	case rtt > slowRTTFactor*c.MinRTT+slowRTTMargin:
+		c.Verdict = "detour"
+	}
+	return c
+}
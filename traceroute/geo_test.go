@@ -0,0 +1,235 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Helpers encoding MMDB data fields.
+
+func mmdbField(typ int, payload []byte) []byte {
+	var b []byte
+	if typ > 7 {
+		b = []byte{byte(len(payload)), byte(typ - 7)}
+	} else {
+		b = []byte{byte(typ<<5 | len(payload))}
+	}
+	return append(b, payload...)
+}
+
+func mmdbStringField(s string) []byte { return mmdbField(mmdbString, []byte(s)) }
+
+func mmdbDoubleField(f float64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	return mmdbField(mmdbDouble, b[:])
+}
+
+func mmdbUint32Field(u uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], u)
+	return mmdbField(mmdbUint32, b[:])
+}
+
+func mmdbMapField(kv map[string][]byte) []byte {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := []byte{byte(mmdbMap<<5 | len(kv))}
+	for _, k := range keys {
+		b = append(b, mmdbStringField(k)...)
+		b = append(b, kv[k]...)
+	}
+	return b
+}
+
+func mmdbPointerField(off int) []byte {
+	return []byte{byte(mmdbPointer<<5 | off>>8&0x7), byte(off)}
+}
+
+type mmdbTestNode struct {
+	child [2]*mmdbTestNode
+	// data holds the data offset of each record, or -1.
+	data [2]int
+}
+
+// writeTestMMDB writes a MMDB file mapping each network to the data at the
+// given offset of data.
+func writeTestMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]int, data []byte) string {
+	t.Helper()
+	root := &mmdbTestNode{data: [2]int{-1, -1}}
+	for cidr, off := range networks {
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		addr := []byte(ip.To4())
+		if ipVersion == 4 && addr == nil {
+			continue
+		}
+		if ipVersion == 6 {
+			if addr == nil {
+				addr = ip.To16()
+			} else {
+				addr = append(make([]byte, 12), addr...)
+				ones += 96
+			}
+		}
+		node := root
+		for i := 0; i < ones-1; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if node.child[bit] == nil {
+				node.child[bit] = &mmdbTestNode{data: [2]int{-1, -1}}
+			}
+			node = node.child[bit]
+		}
+		node.data[addr[(ones-1)/8]>>(7-(ones-1)%8)&1] = off
+	}
+	var nodes []*mmdbTestNode
+	index := map[*mmdbTestNode]int{}
+	for queue := []*mmdbTestNode{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, c := range queue[0].child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	var tree []byte
+	for _, n := range nodes {
+		var rec [2]uint32
+		for i := range rec {
+			switch {
+			case n.child[i] != nil:
+				rec[i] = uint32(index[n.child[i]])
+			case n.data[i] >= 0:
+				rec[i] = uint32(len(nodes) + 16 + n.data[i])
+			default:
+				rec[i] = uint32(len(nodes))
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		case 28:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[0]>>20&0xf0|rec[1]>>24&0x0f), byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		default:
+			var b [8]byte
+			binary.BigEndian.PutUint32(b[:4], rec[0])
+			binary.BigEndian.PutUint32(b[4:], rec[1])
+			tree = append(tree, b[:]...)
+		}
+	}
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, mmdbMapField(map[string][]byte{
+		"node_count":  mmdbUint32Field(uint32(len(nodes))),
+		"record_size": mmdbField(mmdbUint16, []byte{byte(recordSize)}),
+		"ip_version":  mmdbField(mmdbUint16, []byte{byte(ipVersion)}),
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoDB(t *testing.T) {
+	// The country is stored once and referenced by pointers.
+	data := mmdbMapField(map[string][]byte{"iso_code": mmdbStringField("FR")})
+	paris := len(data)
+	data = append(data, mmdbMapField(map[string][]byte{
+		"city":    mmdbMapField(map[string][]byte{"names": mmdbMapField(map[string][]byte{"en": mmdbStringField("Paris")})}),
+		"country": mmdbPointerField(0),
+		"location": mmdbMapField(map[string][]byte{
+			"latitude":  mmdbDoubleField(48.8566),
+			"longitude": mmdbDoubleField(2.3522),
+		}),
+	})...)
+	france := len(data)
+	data = append(data, mmdbMapField(map[string][]byte{"country": mmdbPointerField(0)})...)
+	singapore := len(data)
+	data = append(data, mmdbMapField(map[string][]byte{
+		"city":    mmdbMapField(map[string][]byte{"names": mmdbMapField(map[string][]byte{"en": mmdbStringField("Singapore")})}),
+		"country": mmdbMapField(map[string][]byte{"iso_code": mmdbStringField("SG")}),
+		"location": mmdbMapField(map[string][]byte{
+			"latitude":  mmdbDoubleField(1.3521),
+			"longitude": mmdbDoubleField(103.8198),
+		}),
+	})...)
+	networks := map[string]int{
+		"192.0.2.0/24":    paris,
+		"198.51.100.0/25": france,
+		"203.0.113.0/24":  singapore,
+		"2001:db8::/32":   singapore,
+	}
+
+	for _, tt := range []struct {
+		ipVersion, recordSize int
+	}{{4, 24}, {6, 28}, {6, 32}} {
+		db, err := OpenGeoDB(writeTestMMDB(t, tt.ipVersion, tt.recordSize, networks, data))
+		if err != nil {
+			t.Fatalf("IPv%d/%d: %v", tt.ipVersion, tt.recordSize, err)
+		}
+		for ip, want := range map[string]string{
+			"192.0.2.1":      "Paris, FR",
+			"198.51.100.1":   "FR",
+			"198.51.100.129": "",
+			"203.0.113.1":    "Singapore, SG",
+			"2001:db8::1":    "Singapore, SG",
+		} {
+			if tt.ipVersion == 4 && ip == "2001:db8::1" {
+				want = ""
+			}
+			got := ""
+			if l := db.Lookup(net.ParseIP(ip)); l != nil {
+				got = l.String()
+			}
+			if got != want {
+				t.Errorf("IPv%d/%d: Lookup(%s) = %q, want %q", tt.ipVersion, tt.recordSize, ip, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckRTT(t *testing.T) {
+	paris := &Location{City: "Paris", Country: "FR", Latitude: 48.8566, Longitude: 2.3522}
+	london := &Location{City: "London", Country: "GB", Latitude: 51.5074, Longitude: -0.1278}
+	singapore := &Location{City: "Singapore", Country: "SG", Latitude: 1.3521, Longitude: 103.8198}
+	if d := Distance(*paris, *london); d < 330 || d > 350 {
+		t.Errorf("Distance(Paris, London) = %.0fkm, want about 340km", d)
+	}
+	tests := []struct {
+		to   *Location
+		rtt  time.Duration
+		want string
+	}{
+		{london, 8 * time.Millisecond, "ok"},
+		{london, 2 * time.Millisecond, "impossible"},
+		{london, 250 * time.Millisecond, "detour"},
+		{singapore, 160 * time.Millisecond, "ok"},
+		{paris, 300 * time.Millisecond, "detour"},
+	}
+	for _, tt := range tests {
+		c := CheckRTT(paris, tt.to, tt.rtt)
+		if c == nil || c.Verdict != tt.want {
+			t.Errorf("CheckRTT(Paris, %s, %s) = %v, want %s", tt.to, tt.rtt, c, tt.want)
+		}
+	}
+	if c := CheckRTT(paris, &Location{Country: "FR"}, time.Millisecond); c != nil {
+		t.Errorf("CheckRTT() = %v without coordinates, want nil", c)
+	}
+}
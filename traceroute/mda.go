@@ -0,0 +1,206 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// multipathFailure is the maximum probability for the Multipath
+	// Detection Algorithm to miss an interface at a given hop.
+	multipathFailure = 0.05
+	// maxMultipathFlows bounds the number of flows probed per hop, enough to
+	// find up to 16 interfaces.
+	maxMultipathFlows = 96
+)
+
+// Graph is the result of a multipath trace: the interfaces found at each
+// TTL and the links between interfaces of consecutive TTLs.
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+}
+
+// Node is an interface replying at a given TTL.
+type Node struct {
+	TTL int
+	IP  net.IP
+	// Last is true if the node is the destination.
+	Last bool `json:",omitempty"`
+}
+
+// Edge links two nodes, referenced by their index in Graph.Nodes, that were
+// seen by the same flow at consecutive TTLs.
+type Edge struct {
+	From int
+	To   int
+}
+
+func (g *Graph) String() string {
+	var sb strings.Builder
+	for i, n := range g.Nodes {
+		fmt.Fprintf(&sb, "%3d %14s", n.TTL, n.IP.String())
+		first := true
+		for _, e := range g.Edges {
+			if e.From != i {
+				continue
+			}
+			if first {
+				sb.WriteString(" ->")
+			} else {
+				sb.WriteByte(',')
+			}
+			first = false
+			fmt.Fprintf(&sb, " %s", g.Nodes[e.To].IP)
+		}
+		if i < len(g.Nodes)-1 {
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// multipathProbes returns the number of flows to probe at a hop where k
+// interfaces were found so far to rule out, with a probability of failure of
+// at most multipathFailure, that a k+1th interface exists. Flows are assumed
+// to be evenly spread among interfaces.
+func multipathProbes(k int) int {
+	if k < 1 {
+		k = 1
+	}
+	n := math.Log(multipathFailure/float64(k+1)) / math.Log(float64(k)/float64(k+1))
+	return int(math.Ceil(n))
+}
+
+// flowProbe is a probe of a multipath trace sent with ttl on flow.
+type flowProbe struct {
+	ttl  int
+	flow uint16
+}
+
+// flowProbeFunc sends all the probes at once and calls result with the index
+// of each probe as soon as its outcome is known, whatever the order. Probes
+// past the destination of their flow may be left without a result.
+type flowProbeFunc func(probes []flowProbe, timeout time.Duration, result func(i int, r probeResult)) error
+
+func (t *Tracer) traceMultipathWithFunc(ctx context.Context, cfg traceConfig, probe flowProbeFunc) (*Graph, error) {
+	g := &Graph{}
+	type nodeKey struct {
+		ttl int
+		ip  string
+	}
+	nodes := map[nodeKey]int{}
+	edges := map[Edge]bool{}
+	addNode := func(ttl int, ip net.IP, last bool) int {
+		k := nodeKey{ttl, ip.String()}
+		i, found := nodes[k]
+		if !found {
+			i = len(g.Nodes)
+			nodes[k] = i
+			g.Nodes = append(g.Nodes, Node{TTL: ttl, IP: ip, Last: last})
+		}
+		return i
+	}
+
+	// prev holds the node reached by each flow at the previous TTL.
+	prev := map[uint16]int{}
+	// reached holds the flows which already reached the destination.
+	reached := map[uint16]bool{}
+	var flows uint16
+	// gap is the number of consecutive TTLs without replies.
+	gap := 0
+	var deadline time.Time
+	if cfg.timeout > 0 {
+		deadline = time.Now().Add(cfg.timeout)
+	}
+ttls:
+	for ttl := cfg.firstTTL; ttl <= cfg.maxHops; ttl++ {
+		cur := map[uint16]int{}
+		ifaces := map[string]bool{}
+		var last, transit bool
+		probed := 0
+		// Probe the flows needed so far at once, then more if new
+		// interfaces were found.
+		for flow := uint16(0); flow < maxMultipathFlows && probed < multipathProbes(len(ifaces)); {
+			if err := ctx.Err(); err != nil {
+				return nil, canceledError(err)
+			}
+			timeout := cfg.hopTimeout
+			if !deadline.IsZero() {
+				left := time.Until(deadline)
+				if left <= 0 {
+					break ttls
+				}
+				if left < timeout {
+					timeout = left
+				}
+			}
+			var probes []flowProbe
+			for n := multipathProbes(len(ifaces)) - probed; n > 0 && flow < maxMultipathFlows; flow++ {
+				if reached[flow] {
+					continue
+				}
+				if ttl > cfg.firstTTL && flow >= flows {
+					// New flow, find out where it goes at the previous TTL
+					// to link it to this one.
+					probes = append(probes, flowProbe{ttl: ttl - 1, flow: flow})
+				}
+				probes = append(probes, flowProbe{ttl: ttl, flow: flow})
+				n--
+			}
+			if len(probes) == 0 {
+				break
+			}
+			results := make([]*probeResult, len(probes))
+			err := probe(probes, timeout, func(i int, r probeResult) {
+				results[i] = &r
+			})
+			if err != nil {
+				return nil, err
+			}
+			for i, p := range probes {
+				r := results[i]
+				if p.ttl < ttl {
+					if r != nil && r.info.IP != nil {
+						prev[p.flow] = addNode(p.ttl, r.info.IP, r.last)
+					}
+					continue
+				}
+				probed++
+				if p.flow >= flows {
+					flows = p.flow + 1
+				}
+				if r == nil || r.info.IP == nil {
+					continue
+				}
+				node := addNode(ttl, r.info.IP, r.last)
+				cur[p.flow] = node
+				ifaces[r.info.IP.String()] = true
+				if from, found := prev[p.flow]; found && !edges[Edge{from, node}] {
+					edges[Edge{from, node}] = true
+					g.Edges = append(g.Edges, Edge{From: from, To: node})
+				}
+				if r.last {
+					reached[p.flow] = true
+					last = true
+				} else {
+					transit = true
+				}
+			}
+		}
+		if last && !transit {
+			break
+		}
+		if len(ifaces) > 0 {
+			gap = 0
+		} else if gap++; gap == cfg.gapLimit {
+			break
+		}
+		prev = cur
+	}
+	return g, nil
+}
@@ -0,0 +1,173 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultipathProbes(t *testing.T) {
+	// Values from the MDA paper for a 95% confidence.
+	want := []int{6, 6, 11, 16, 21, 27, 33}
+	for k, n := range want {
+		if got := multipathProbes(k); got != n {
+			t.Errorf("multipathProbes(%d) = %d, want %d", k, got, n)
+		}
+	}
+}
+
+// flowProbes returns a flowProbeFunc answering each probe with reply and
+// appending each batch to batches.
+func flowProbes(reply func(ttl int, flow uint16) (HopInfo, bool), batches *[][]flowProbe) flowProbeFunc {
+	return func(probes []flowProbe, timeout time.Duration, result func(int, probeResult)) error {
+		*batches = append(*batches, probes)
+		for i, p := range probes {
+			info, last := reply(p.ttl, p.flow)
+			result(i, probeResult{info: info, last: last})
+		}
+		return nil
+	}
+}
+
+func TestTraceMultipathWithFunc(t *testing.T) {
+	a := net.IPv4(192, 0, 2, 1)
+	b := net.IPv4(192, 0, 2, 2)
+	c := net.IPv4(192, 0, 2, 3)
+	dest := net.IPv4(203, 0, 113, 1)
+	probes := map[int]int{}
+	var batches [][]flowProbe
+	probe := flowProbes(func(ttl int, flow uint16) (HopInfo, bool) {
+		probes[ttl]++
+		switch ttl {
+		case 1:
+			return HopInfo{IP: a, RTT: time.Millisecond}, false
+		case 2:
+			// Per-flow load balancing between b and c.
+			if flow%2 == 0 {
+				return HopInfo{IP: b, RTT: time.Millisecond}, false
+			}
+			return HopInfo{IP: c, RTT: time.Millisecond}, false
+		default:
+			return HopInfo{IP: dest, RTT: time.Millisecond}, true
+		}
+	}, &batches)
+	tr := Tracer{MaxHops: 5}
+	g, err := tr.traceMultipathWithFunc(context.Background(), tr.traceConfig(dest), probe)
+	if err != nil {
+		t.Fatalf("traceMultipathWithFunc() error = %v", err)
+	}
+	wantNodes := []Node{
+		{TTL: 1, IP: a},
+		{TTL: 2, IP: b},
+		{TTL: 2, IP: c},
+		{TTL: 3, IP: dest, Last: true},
+	}
+	if !reflect.DeepEqual(g.Nodes, wantNodes) {
+		t.Fatalf("nodes = %v, want %v", g.Nodes, wantNodes)
+	}
+	wantEdges := []Edge{{0, 1}, {0, 2}, {1, 3}, {2, 3}}
+	if !reflect.DeepEqual(g.Edges, wantEdges) {
+		t.Fatalf("edges = %v, want %v", g.Edges, wantEdges)
+	}
+	if got, want := probes[2], multipathProbes(2); got != want {
+		t.Fatalf("probes at ttl 2 = %d, want %d", got, want)
+	}
+	if _, found := probes[4]; found {
+		t.Fatal("probed past the destination")
+	}
+	// TTL 2 takes a second batch for the flows needed once two interfaces
+	// are found, along with the first TTL of the new flows.
+	wantBatches := [][]flowProbe{
+		{{1, 0}, {1, 1}, {1, 2}, {1, 3}, {1, 4}, {1, 5}},
+		{{2, 0}, {2, 1}, {2, 2}, {2, 3}, {2, 4}, {2, 5}},
+		{{1, 6}, {2, 6}, {1, 7}, {2, 7}, {1, 8}, {2, 8}, {1, 9}, {2, 9}, {1, 10}, {2, 10}},
+		{{3, 0}, {3, 1}, {3, 2}, {3, 3}, {3, 4}, {3, 5}},
+	}
+	if !reflect.DeepEqual(batches, wantBatches) {
+		t.Fatalf("batches = %v, want %v", batches, wantBatches)
+	}
+}
+
+func TestTraceMultipathWithFuncGapLimit(t *testing.T) {
+	a := net.IPv4(192, 0, 2, 1)
+	probes := map[int]int{}
+	var batches [][]flowProbe
+	probe := flowProbes(func(ttl int, flow uint16) (HopInfo, bool) {
+		probes[ttl]++
+		if ttl == 1 {
+			return HopInfo{IP: a, RTT: time.Millisecond}, false
+		}
+		// The destination is filtered, nothing replies past the first hop.
+		return HopInfo{RTT: -1}, false
+	}, &batches)
+	tr := Tracer{MaxHops: 30, GapLimit: 3}
+	g, err := tr.traceMultipathWithFunc(context.Background(), tr.traceConfig(net.IPv4(203, 0, 113, 1)), probe)
+	if err != nil {
+		t.Fatalf("traceMultipathWithFunc() error = %v", err)
+	}
+	if want := []Node{{TTL: 1, IP: a}}; !reflect.DeepEqual(g.Nodes, want) {
+		t.Fatalf("nodes = %v, want %v", g.Nodes, want)
+	}
+	for ttl := range probes {
+		if ttl > 4 {
+			t.Fatalf("probed ttl %d past the gap of TTLs 2 to 4", ttl)
+		}
+	}
+	if _, found := probes[4]; !found {
+		t.Fatal("ttl 4 not probed")
+	}
+	// The flows of a silent TTL share a single timeout.
+	if got, want := len(batches), 4; got != want {
+		t.Fatalf("%d batches, want %d", got, want)
+	}
+}
+
+func TestTraceMultipathWithFuncFirstTTL(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 1)
+	probes := map[int]int{}
+	var batches [][]flowProbe
+	probe := flowProbes(func(ttl int, flow uint16) (HopInfo, bool) {
+		probes[ttl]++
+		if ttl < 3 {
+			return HopInfo{IP: net.IPv4(192, 0, 2, byte(ttl)), RTT: time.Millisecond}, false
+		}
+		return HopInfo{IP: dest, RTT: time.Millisecond}, true
+	}, &batches)
+	tr := Tracer{MaxHops: 5, FirstTTL: 2}
+	g, err := tr.traceMultipathWithFunc(context.Background(), tr.traceConfig(dest), probe)
+	if err != nil {
+		t.Fatalf("traceMultipathWithFunc() error = %v", err)
+	}
+	if want := []Node{{TTL: 2, IP: net.IPv4(192, 0, 2, 2)}, {TTL: 3, IP: dest, Last: true}}; !reflect.DeepEqual(g.Nodes, want) {
+		t.Fatalf("nodes = %v, want %v", g.Nodes, want)
+	}
+	if _, found := probes[1]; found {
+		t.Fatal("probed below the first TTL")
+	}
+}
+
+func TestTraceMultipathWithFuncTimeout(t *testing.T) {
+	tr := Tracer{MaxHops: 30, HopTimeout: time.Second, Timeout: 50 * time.Millisecond}
+	var timeouts []time.Duration
+	probe := func(probes []flowProbe, timeout time.Duration, result func(int, probeResult)) error {
+		timeouts = append(timeouts, timeout)
+		time.Sleep(timeout)
+		for i := range probes {
+			result(i, probeResult{info: HopInfo{RTT: -1}})
+		}
+		return nil
+	}
+	if _, err := tr.traceMultipathWithFunc(context.Background(), tr.traceConfig(net.IPv4(203, 0, 113, 1)), probe); err != nil {
+		t.Fatalf("traceMultipathWithFunc() error = %v", err)
+	}
+	if len(timeouts) == 0 {
+		t.Fatal("nothing probed")
+	}
+	for _, d := range timeouts {
+		if d > tr.Timeout {
+			t.Fatalf("probe timeout %s past the trace timeout %s", d, tr.Timeout)
+		}
+	}
+}
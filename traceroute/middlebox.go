@@ -0,0 +1,170 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Modifications of the probes detected from the headers quoted by routers.
+// Rewritten IPv4 identifications are not detected as the kernel picks the
+// identification of probes, unknown to the Tracer.
+const (
+	// ModNAT is a rewritten source address.
+	ModNAT = "nat"
+	// ModDSCP and ModECN are rewritten DSCP and ECN bits of the TOS or
+	// traffic class, like DSCP bleaching.
+	ModDSCP = "dscp"
+	ModECN  = "ecn"
+	// ModFlowLabel is a rewritten IPv6 flow label.
+	ModFlowLabel = "flow-label"
+	// ModLength is a changed IPv4 total length or IPv6 payload length.
+	ModLength = "length"
+	// ModChecksum is a rewritten transport checksum with an unchanged
+	// source address, NAT implying checksum changes.
+	ModChecksum = "checksum"
+)
+
+// quotedHeader holds the fields of a probe quoted in an ICMP error.
+type quotedHeader struct {
+	src net.IP
+	// tos is the TOS or traffic class.
+	tos int
+	// flowLabel is the IPv6 flow label.
+	flowLabel int
+	// length is the IPv4 total length or the IPv6 payload length.
+	length int
+	// checksum is the checksum of the transport header, if quoted.
+	checksum    uint16
+	hasChecksum bool
+}
+
+// parseQuotedHeader parses the IP header quoted at the start of b and the
+// checksum of the transport header at offset o, if quoted.
+func parseQuotedHeader(family int, b []byte, o, proto int) *quotedHeader {
+	var q quotedHeader
+	if family == 4 {
+		// Unlike ipv4.ParseHeader, icmp.ParseIPv4Header does not expect
+		// the byte order of the local raw sockets.
+		h, err := icmp.ParseIPv4Header(b)
+		if err != nil {
+			return nil
+		}
+		q = quotedHeader{src: h.Src, tos: h.TOS, length: h.TotalLen}
+	} else {
+		h, err := ipv6.ParseHeader(b)
+		if err != nil {
+			return nil
+		}
+		q = quotedHeader{src: h.Src, tos: h.TrafficClass, flowLabel: h.FlowLabel, length: h.PayloadLen}
+	}
+	var c int
+	switch proto {
+	case protocolICMP, protocolIPv6ICMP:
+		c = 2
+	case protocolUDP:
+		c = 6
+	case protocolTCP:
+		c = 16
+	default:
+		return &q
+	}
+	if o+c+2 <= len(b) {
+		q.checksum, q.hasChecksum = binary.BigEndian.Uint16(b[o+c:]), true
+	}
+	return &q
+}
+
+// trafficClass is the TOS or traffic class and the flow label probes are
+// sent with. A zero flow label is left to the system.
+type trafficClass struct {
+	tos       int
+	flowLabel int
+}
+
+// sentProbe holds the fields of a probe as sent. Unknown fields are left to
+// their zero value.
+type sentProbe struct {
+	src         net.IP
+	class       trafficClass
+	length      int
+	checksum    uint16
+	hasChecksum bool
+	// partialChecksum is the pseudo header sum the kernel leaves in the
+	// checksum field when offloading it, quoted as is by routers behind
+	// virtual interfaces not computing it. Zero when not applicable.
+	partialChecksum uint16
+}
+
+// newSentProbe returns the description of a probe of the given transport
+// length sent from src with class.
+func newSentProbe(family int, src net.IP, length int, class trafficClass) sentProbe {
+	s := sentProbe{src: src, class: class, length: length}
+	if family == 4 {
+		s.length += ipv4.HeaderLen
+	}
+	return s
+}
+
+// modifications returns the modifications of the probe s quoted as q.
+func (s sentProbe) modifications(q quotedHeader) []string {
+	var mods []string
+	nat := s.src != nil && !s.src.Equal(q.src)
+	if nat {
+		mods = append(mods, ModNAT)
+	}
+	if s.class.tos>>2 != q.tos>>2 {
+		mods = append(mods, ModDSCP)
+	}
+	if s.class.tos&0x3 != q.tos&0x3 {
+		mods = append(mods, ModECN)
+	}
+	if s.class.flowLabel != 0 && s.class.flowLabel != q.flowLabel {
+		mods = append(mods, ModFlowLabel)
+	}
+	if s.length != 0 && s.length != q.length {
+		mods = append(mods, ModLength)
+	}
+	if !nat && s.hasChecksum && q.hasChecksum && s.checksum != q.checksum && (s.partialChecksum == 0 || s.partialChecksum != q.checksum) {
+		mods = append(mods, ModChecksum)
+	}
+	return mods
+}
+
+// Middlebox is a modification of the probes happening on the path, between
+// the hop first reporting it and the previous one.
+type Middlebox struct {
+	// Modification is one of the Mod constants.
+	Modification string
+	Hop          int
+	IP           net.IP `json:",omitempty"`
+}
+
+func (m Middlebox) String() string {
+	if m.IP == nil {
+		return fmt.Sprintf("%s before hop %d", m.Modification, m.Hop)
+	}
+	return fmt.Sprintf("%s before hop %d (%s)", m.Modification, m.Hop, m.IP)
+}
+
+// Middleboxes returns the modifications of the probes reported by hops, with
+// the first hop reporting each of them.
+func Middleboxes(hops []Hop) []Middlebox {
+	var boxes []Middlebox
+	seen := map[string]bool{}
+	for _, h := range hops {
+		for _, info := range h.Info {
+			for _, m := range info.Modifications {
+				if !seen[m] {
+					seen[m] = true
+					boxes = append(boxes, Middlebox{Modification: m, Hop: h.Seq, IP: info.IP})
+				}
+			}
+		}
+	}
+	return boxes
+}
@@ -0,0 +1,107 @@
+package traceroute
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuotedHeader(t *testing.T) {
+	v4 := []byte{
+		0x45, 0xb8, 0, 30, 0x12, 0x34, 0x40, 0, 1, protocolUDP, 0, 0,
+		10, 0, 0, 1, 203, 0, 113, 1,
+		0x9c, 0x40, 0, 53, 0, 10, 0xab, 0xcd,
+	}
+	v6 := append([]byte{
+		0x6b, 0x81, 0x23, 0x45, 0, 8, protocolIPv6ICMP, 1,
+	}, append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)...)
+	v6 = append(v6, 128, 0, 0xbe, 0xef, 0, 1, 0, 2)
+	tests := []struct {
+		name   string
+		family int
+		b      []byte
+		o      int
+		proto  int
+		want   *quotedHeader
+	}{
+		{"v4", 4, v4, 20, protocolUDP, &quotedHeader{
+			src: net.IPv4(10, 0, 0, 1), tos: 0xb8, length: 30,
+			checksum: 0xabcd, hasChecksum: true,
+		}},
+		{"v4 truncated", 4, v4[:26], 20, protocolUDP, &quotedHeader{
+			src: net.IPv4(10, 0, 0, 1), tos: 0xb8, length: 30,
+		}},
+		{"v6", 6, v6, 40, protocolIPv6ICMP, &quotedHeader{
+			src: net.ParseIP("2001:db8::1"), tos: 0xb8, flowLabel: 0x12345, length: 8,
+			checksum: 0xbeef, hasChecksum: true,
+		}},
+		{"v4 invalid", 4, v4[:10], 20, protocolUDP, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseQuotedHeader(tt.family, tt.b, tt.o, tt.proto); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQuotedHeader() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSentProbeModifications(t *testing.T) {
+	src := net.IPv4(10, 0, 0, 1)
+	sent := sentProbe{src: src, class: trafficClass{tos: 0xb8}, length: 30, checksum: 0xabcd, hasChecksum: true, partialChecksum: 0x5678}
+	quoted := quotedHeader{src: src, tos: 0xb8, length: 30, checksum: 0xabcd, hasChecksum: true}
+	tests := []struct {
+		name   string
+		modify func(q *quotedHeader)
+		want   []string
+	}{
+		{"none", func(q *quotedHeader) {}, nil},
+		{"nat", func(q *quotedHeader) {
+			q.src = net.IPv4(192, 0, 2, 1)
+			q.checksum = 0x1234
+		}, []string{ModNAT}},
+		{"dscp bleaching", func(q *quotedHeader) { q.tos = 0 }, []string{ModDSCP}},
+		{"ecn", func(q *quotedHeader) { q.tos |= 0x1 }, []string{ModECN}},
+		{"flow label left to the system", func(q *quotedHeader) { q.flowLabel = 0x12345 }, nil},
+		{"length", func(q *quotedHeader) { q.length = 40 }, []string{ModLength}},
+		{"checksum", func(q *quotedHeader) { q.checksum = 0x1234 }, []string{ModChecksum}},
+		{"checksum not quoted", func(q *quotedHeader) { q.checksum, q.hasChecksum = 0, false }, nil},
+		{"partial checksum", func(q *quotedHeader) { q.checksum = 0x5678 }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := quoted
+			tt.modify(&q)
+			if got := sent.modifications(q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("modifications() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	sent.class.flowLabel = 0x12345
+	if got, want := sent.modifications(quoted), []string{ModFlowLabel}; !reflect.DeepEqual(got, want) {
+		t.Errorf("modifications() = %v, want %v", got, want)
+	}
+}
+
+func TestMiddleboxes(t *testing.T) {
+	hop1 := net.IPv4(192, 0, 2, 1)
+	hop2 := net.IPv4(192, 0, 2, 2)
+	hops := []Hop{
+		{Seq: 1, Info: []HopInfo{{IP: hop1}}},
+		{Seq: 2, Info: []HopInfo{{IP: hop2, Modifications: []string{ModNAT}}, {IP: hop2, Modifications: []string{ModNAT, ModDSCP}}}},
+		{Seq: 3, Info: []HopInfo{{IP: nil}}},
+		{Seq: 4, Info: []HopInfo{{IP: net.IPv4(192, 0, 2, 4), Modifications: []string{ModNAT, ModDSCP}}}},
+	}
+	want := []Middlebox{
+		{Modification: ModNAT, Hop: 2, IP: hop2},
+		{Modification: ModDSCP, Hop: 2, IP: hop2},
+	}
+	got := Middleboxes(hops)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Middleboxes() = %v, want %v", got, want)
+	}
+	if s, want := got[0].String(), "nat before hop 2 (192.0.2.2)"; s != want {
+		t.Errorf("String() = %q, want %q", s, want)
+	}
+}
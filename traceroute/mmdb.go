@@ -0,0 +1,268 @@
+package traceroute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of MaxMind DB files.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalidMMDB = errors.New("invalid MMDB data")
+
+// mmdbReader reads MaxMind DB files, as specified at
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node of ::/96 in IPv6 trees, where IPv4 addresses
+	// are stored.
+	ipv4Start uint
+}
+
+func newMMDBReader(b []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid MMDB file: metadata not found")
+	}
+	v, _, err := mmdbDecoder(b[i+len(mmdbMetadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MMDB metadata: %v", err)
+	}
+	meta, _ := v.(map[string]interface{})
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("invalid MMDB metadata: record size %d", recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("invalid MMDB metadata: IP version %d", ipVersion)
+	}
+	treeSize := nodeCount * recordSize / 4
+	// The tree is followed by 16 zero bytes then the data section.
+	if treeSize+16 > uint64(i) {
+		return nil, errors.New("invalid MMDB metadata: node count too large")
+	}
+	r := &mmdbReader{
+		tree:       b[:treeSize],
+		data:       mmdbDecoder(b[treeSize+16 : i]),
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the data stored for ip, or nil if there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		// Not found.
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errInvalidMMDB
+	}
+	v, _, err := r.data.decode(node-r.nodeCount-16, 0)
+	return v, err
+}
+
+// record returns the left (0) or right (1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes the values of a data section. Pointers are offsets
+// from its start.
+type mmdbDecoder []byte
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode decodes the value at off and returns the offset following it. Maps
+// are decoded to map[string]interface{}, arrays to []interface{} and
+// unsigned integers to uint64, keeping only the low bits of 128 bit ones.
+func (d mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errInvalidMMDB
+	}
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	off++
+	typ := int(b[0] >> 5)
+	if typ == mmdbPointer {
+		size := uint(b[0]>>3) & 0x3
+		pb, err := d.bytes(off, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += size + 1
+		ptr := uint(b[0] & 0x7)
+		if size == 3 {
+			ptr = 0
+		}
+		for _, c := range pb {
+			ptr = ptr<<8 | uint(c)
+		}
+		switch size {
+		case 1:
+			ptr += 2048
+		case 2:
+			ptr += 526336
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, off, err
+	}
+	if typ == mmdbExtended {
+		eb, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		off++
+		typ = 7 + int(eb[0])
+	}
+	size := uint(b[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		sb, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		size = 0
+		for _, c := range sb {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errInvalidMMDB
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	vb, err := d.bytes(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(vb), off, nil
+	case mmdbBytes:
+		return append([]byte(nil), vb...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errInvalidMMDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(vb)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errInvalidMMDB
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(vb))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		var u uint64
+		for _, c := range vb {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case mmdbInt32:
+		var u uint32
+		for _, c := range vb {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), off, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MMDB data type %d", typ)
+	}
+}
+
+func (d mmdbDecoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d)) || off+n < off {
+		return nil, errInvalidMMDB
+	}
+	return d[off : off+n], nil
+}
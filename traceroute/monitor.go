@@ -0,0 +1,168 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultMonitorInterval is the default time between two cycles of a
+// Monitor.
+const DefaultMonitorInterval = time.Second
+
+// DefaultMonitorHistory is the default number of most recent samples kept
+// per hop by a Monitor, like mtr does.
+const DefaultMonitorHistory = 100
+
+// Monitor continuously traces the route to a destination, like mtr does,
+// probing every hop up to the destination once per cycle.
+type Monitor struct {
+	// Tracer sets how probes are sent. Its Probes field is ignored, each
+	// cycle sending one probe per hop, and so is its Timeout, Duration
+	// bounding the whole run instead. Its GapLimit applies to the first
+	// cycle, later ones not probing past the gap found.
+	Tracer Tracer
+
+	// Interval is the time between the start of two cycles. It defaults to
+	// DefaultMonitorInterval.
+	Interval time.Duration
+
+	// Count is the number of cycles to run. Duration is the maximum time to
+	// run for. The monitor runs until the context is done if both are zero.
+	Count    int
+	Duration time.Duration
+
+	// History is the number of most recent samples kept per hop, and thus
+	// accounted for in their statistics. It defaults to
+	// DefaultMonitorHistory. All samples are kept if negative.
+	History int
+}
+
+// Snapshot is the state of a Monitor at the end of a cycle.
+type Snapshot struct {
+	// Cycle is the number of cycles done, starting at 1.
+	Cycle int
+	// Hops holds the samples kept for each hop up to the destination. Hops
+	// are owned by the receiver of the snapshot.
+	Hops []Hop
+}
+
+// Run monitors the route to dest, sending a snapshot on c at the end of each
+// cycle. It returns once Count cycles are done or Duration elapsed, or with
+// an error if ctx is done before.
+func (m *Monitor) Run(ctx context.Context, dest net.IP, c chan<- Snapshot) error {
+	cfg := m.Tracer.traceConfig(dest)
+	runCtx := ctx
+	if m.Duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, m.Duration)
+		defer cancel()
+	}
+	probe, closeProbe, err := m.Tracer.openProbe(runCtx, cfg, dest)
+	if err != nil {
+		return err
+	}
+	defer closeProbe()
+	err = m.runWithFunc(runCtx, cfg, c, probe)
+	if err != nil && ctx.Err() == nil && runCtx.Err() != nil {
+		// Duration elapsed.
+		return nil
+	}
+	return err
+}
+
+func (m *Monitor) runWithFunc(ctx context.Context, cfg traceConfig, c chan<- Snapshot, probe batchProbeFunc) error {
+	interval := m.Interval
+	if interval == 0 {
+		interval = DefaultMonitorInterval
+	}
+	history := m.History
+	if history == 0 {
+		history = DefaultMonitorHistory
+	}
+	hops := make([]Hop, cfg.maxHops)
+	for i := range hops {
+		hops[i].Seq = i + 1
+	}
+	lastHop := cfg.maxHops
+	// reached is true once the destination replied.
+	reached := false
+	for cycle := 1; m.Count == 0 || cycle <= m.Count; cycle++ {
+		start := time.Now()
+		for first := cfg.firstTTL; first <= lastHop; first += cfg.window {
+			if err := ctx.Err(); err != nil {
+				return canceledError(err)
+			}
+			end := first + cfg.window - 1
+			if end > lastHop {
+				end = lastHop
+			}
+			ttls := make([]int, 0, end-first+1)
+			for ttl := first; ttl <= end; ttl++ {
+				ttls = append(ttls, ttl)
+			}
+			err := probe(ttls, cfg.hopTimeout, func(i int, r probeResult) {
+				ttl := ttls[i]
+				if ttl > lastHop {
+					return
+				}
+				m.Tracer.annotate(&r.info)
+				h := &hops[ttl-1]
+				h.Info = append(h.Info, r.info)
+				if history > 0 && len(h.Info) > history {
+					h.Info = h.Info[len(h.Info)-history:]
+				}
+				if r.last {
+					lastHop = ttl
+					reached = true
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if cycle == 1 && cfg.gapLimit > 0 && !reached {
+			gap := 0
+			for ttl := cfg.firstTTL; ttl <= lastHop; ttl++ {
+				if info := hops[ttl-1].Info; len(info) > 0 && info[0].IP != nil {
+					gap = 0
+				} else if gap++; gap == cfg.gapLimit {
+					// Keep the silent hops, like a trace does.
+					lastHop = ttl
+					break
+				}
+			}
+		}
+
+		s := Snapshot{Cycle: cycle, Hops: make([]Hop, lastHop-cfg.firstTTL+1)}
+		for i, h := range hops[cfg.firstTTL-1 : lastHop] {
+			s.Hops[i] = Hop{Seq: h.Seq, Info: append([]HopInfo(nil), h.Info...)}
+			if m.Tracer.Names == nil {
+				continue
+			}
+			// Names show up in the snapshots following their resolution.
+			for j, info := range s.Hops[i].Info {
+				if info.IP != nil {
+					s.Hops[i].Info[j].Name = m.Tracer.Names.cachedName(info.IP)
+				}
+			}
+		}
+		select {
+		case c <- s:
+		case <-ctx.Done():
+			return canceledError(ctx.Err())
+		}
+
+		if m.Count != 0 && cycle == m.Count {
+			break
+		}
+		t := time.NewTimer(time.Until(start.Add(interval)))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return canceledError(ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMonitorRunWithFunc(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 20)
+	var probed [][]int
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		probed = append(probed, ttls)
+		for i, ttl := range ttls {
+			switch {
+			case ttl == 1 && len(probed)%2 == 0:
+				// Every other probe to the first hop is lost.
+				result(i, probeResult{info: HopInfo{RTT: -1}})
+			case ttl == 1:
+				result(i, probeResult{info: HopInfo{IP: net.IPv4(192, 0, 2, 1), RTT: time.Millisecond}})
+			default:
+				result(i, probeResult{info: HopInfo{IP: dest, RTT: 2 * time.Millisecond}, last: true})
+			}
+		}
+		return nil
+	}
+	m := &Monitor{
+		Tracer:   Tracer{MaxHops: 5},
+		Interval: time.Nanosecond,
+		Count:    3,
+		History:  2,
+	}
+	c := make(chan Snapshot, 3)
+	if err := m.runWithFunc(context.Background(), m.Tracer.traceConfig(dest), c, probe); err != nil {
+		t.Fatalf("runWithFunc() error = %v", err)
+	}
+	close(c)
+
+	if got, want := len(probed), 3; got != want {
+		t.Fatalf("cycles probed = %d, want %d", got, want)
+	}
+	if got, want := len(probed[0]), 5; got != want {
+		t.Fatalf("first cycle TTLs = %v, want %d TTLs", probed[0], want)
+	}
+	if got, want := probed[1], []int{1, 2}; len(got) != len(want) {
+		t.Fatalf("second cycle TTLs = %v, want %v", got, want)
+	}
+	var snapshots []Snapshot
+	for s := range c {
+		snapshots = append(snapshots, s)
+	}
+	if got, want := len(snapshots), 3; got != want {
+		t.Fatalf("snapshots = %d, want %d", got, want)
+	}
+	for i, s := range snapshots {
+		if s.Cycle != i+1 || len(s.Hops) != 2 {
+			t.Fatalf("snapshot %d = %+v, want cycle %d with 2 hops", i, s, i+1)
+		}
+	}
+	if got, want := len(snapshots[0].Hops[0].Info), 1; got != want {
+		t.Fatalf("first snapshot samples = %d, want %d", got, want)
+	}
+	// Only the last two samples are kept: lost, then answered.
+	st := snapshots[2].Hops[0].Stats()
+	if st.Sent != 2 || st.Received != 1 || st.Loss != 0.5 {
+		t.Fatalf("last snapshot hop 1 stats = %+v, want 1 out of 2 received", st)
+	}
+}
+
+func TestMonitorDefaultHistory(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 20)
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		result(0, probeResult{info: HopInfo{IP: dest, RTT: time.Millisecond}, last: true})
+		return nil
+	}
+	m := &Monitor{
+		Tracer:   Tracer{MaxHops: 1},
+		Interval: time.Nanosecond,
+		Count:    DefaultMonitorHistory + 5,
+	}
+	c := make(chan Snapshot, m.Count)
+	if err := m.runWithFunc(context.Background(), m.Tracer.traceConfig(dest), c, probe); err != nil {
+		t.Fatalf("runWithFunc() error = %v", err)
+	}
+	close(c)
+	var last Snapshot
+	for s := range c {
+		last = s
+	}
+	if got, want := len(last.Hops[0].Info), DefaultMonitorHistory; got != want {
+		t.Fatalf("samples kept = %d, want %d", got, want)
+	}
+}
+
+func TestMonitorGapLimit(t *testing.T) {
+	var probed [][]int
+	// Only the first hop replies.
+	probe := pathProbe([]int{1}, false, &probed)
+	m := &Monitor{
+		Tracer:   Tracer{MaxHops: 10, GapLimit: 3},
+		Interval: time.Nanosecond,
+		Count:    2,
+	}
+	c := make(chan Snapshot, m.Count)
+	if err := m.runWithFunc(context.Background(), m.Tracer.traceConfig(net.IPv4(203, 0, 113, 20)), c, probe); err != nil {
+		t.Fatalf("runWithFunc() error = %v", err)
+	}
+	close(c)
+	if got, want := probed[1], []int{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second cycle TTLs = %v, want %v", got, want)
+	}
+	for s := range c {
+		if got, want := len(s.Hops), 4; got != want {
+			t.Fatalf("snapshot %d has %d hops, want %d", s.Cycle, got, want)
+		}
+	}
+}
+
+func TestMonitorRunWithFuncCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		cancel()
+		return nil
+	}
+	m := &Monitor{Tracer: Tracer{MaxHops: 1}}
+	err := m.runWithFunc(ctx, m.Tracer.traceConfig(net.IPv4(203, 0, 113, 20)), make(chan Snapshot), probe)
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("runWithFunc() error = %v, want ErrCanceled", err)
+	}
+}
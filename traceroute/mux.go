@@ -0,0 +1,345 @@
+//go:build !windows
+// +build !windows
+
+package traceroute
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mux shares raw sockets among the Tracers and Pingers using it, so that
+// concurrent traces do not each receive and parse every ICMP packet of the
+// host. Packets read on a shared socket are parsed once and dispatched to
+// the traces they reply to: by Echo ID for ICMP probes, unique among the
+// traces sharing a Mux, and by port for UDP and TCP probes. Sockets are
+// opened by the first trace needing them and closed with the last one.
+//
+// The zero value is ready to use. Probes with a flow label, datagram ICMP
+// sockets and path MTU discovery use sockets of their own.
+type Mux struct {
+	mu      sync.Mutex
+	sockets map[muxKey]*muxSocket
+	// echoIDs are the Echo IDs in use by the traces sharing the Mux.
+	echoIDs map[int]bool
+}
+
+// muxKey identifies the sockets which can be shared: the packets they send
+// only differ by their TTL and payload.
+type muxKey struct {
+	// network is "icmp" or "tcp".
+	network string
+	family  int
+	src     string
+	iface   string
+	tos     int
+}
+
+// muxSocket is a socket shared through a Mux. Writes are serialized as the
+// hop limit is set for the whole socket.
+type muxSocket struct {
+	m    *Mux
+	key  muxKey
+	conn packetConn
+	read func(conn packetConn) (packetInfo, error)
+	wmu  sync.Mutex
+	// mu protects conns, the traces sharing the socket.
+	mu    sync.Mutex
+	conns map[*muxConn]bool
+}
+
+// packetOwner is implemented by probers telling the packets replying to any
+// of their probes, for them to be dispatched the packets of shared sockets.
+type packetOwner interface {
+	owns(p packetInfo) bool
+}
+
+// muxQueueLen is the number of packets queued for a trace not reading them
+// yet, past which they are dropped like they would be by a socket buffer.
+const muxQueueLen = 256
+
+var errMuxConnClosed = errors.New("use of closed shared connection")
+
+// open returns a packetConn of the given network, "icmp" or "tcp", for cfg.
+// It is shared through m unless m is nil or the socket cannot be shared.
+func (m *Mux) open(network string, cfg traceConfig, dest net.IP) (packetConn, error) {
+	newConn := newPacketConn
+	if network == "tcp" {
+		newConn = newTCPConn
+	}
+	if m == nil || cfg.class.flowLabel != 0 {
+		// Flow labels are leased per destination.
+		conn, err := newConn(cfg.family, cfg.bind)
+		if err != nil {
+			return nil, err
+		}
+		return setTrafficClass(conn, cfg, dest)
+	}
+	key := muxKey{
+		network: network,
+		family:  cfg.family,
+		iface:   cfg.bind.iface,
+		tos:     cfg.class.tos,
+	}
+	if cfg.bind.src != nil {
+		key.src = cfg.bind.src.String()
+	}
+	c, err := m.conn(key, func() (packetConn, error) {
+		conn, err := newConn(cfg.family, cfg.bind)
+		if err != nil {
+			return nil, err
+		}
+		return setTrafficClass(conn, cfg, dest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// conn returns a packetConn sharing the socket identified by key, opened
+// with newConn if no trace uses it yet.
+func (m *Mux) conn(key muxKey, newConn func() (packetConn, error)) (*muxConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sockets[key]
+	if s == nil {
+		conn, err := newConn()
+		if err != nil {
+			return nil, err
+		}
+		s = &muxSocket{m: m, key: key, conn: conn, conns: map[*muxConn]bool{}}
+		if key.network == "tcp" {
+			s.read = readTCPPacket
+		} else {
+			s.read = func(conn packetConn) (packetInfo, error) {
+				return readPacket(conn, key.family)
+			}
+		}
+		if m.sockets == nil {
+			m.sockets = map[muxKey]*muxSocket{}
+		}
+		m.sockets[key] = s
+		go s.readLoop()
+	}
+	c := &muxConn{
+		s:       s,
+		id:      -1,
+		packets: make(chan packetInfo, muxQueueLen),
+		done:    make(chan struct{}),
+	}
+	if key.network == "icmp" {
+		c.id = m.newEchoID()
+	}
+	s.mu.Lock()
+	s.conns[c] = true
+	s.mu.Unlock()
+	return c, nil
+}
+
+// newEchoID returns an Echo ID not in use by the traces sharing m. m.mu
+// must be held.
+func (m *Mux) newEchoID() int {
+	if m.echoIDs == nil {
+		m.echoIDs = map[int]bool{}
+	}
+	for {
+		id := rand.Intn(0xffff)
+		if !m.echoIDs[id] {
+			m.echoIDs[id] = true
+			return id
+		}
+	}
+}
+
+// readLoop reads the packets of the socket and dispatches them to their
+// owners until the socket fails or is closed.
+func (s *muxSocket) readLoop() {
+	for {
+		p, err := s.read(s.conn)
+		if err != nil {
+			var e *Error
+			if errors.As(err, &e) && e.Kind == ErrParse {
+				continue
+			}
+			s.fail(err)
+			return
+		}
+		if !p.Valid {
+			continue
+		}
+		s.mu.Lock()
+		for c := range s.conns {
+			// Port ranges of TCP probes may overlap, the packet is then
+			// left for the owners to match.
+			if c.owner != nil && c.owner.owns(p) {
+				select {
+				case c.packets <- p:
+				default:
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fail makes reads of all the traces sharing the socket return err.
+func (s *muxSocket) fail(err error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.m.sockets[s.key] == s {
+		delete(s.m.sockets, s.key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.close(err)
+	}
+}
+
+// muxConn is the packetConn of a trace sharing a muxSocket. Packets are read
+// with readPacket or readTCPPacket, whichever matches the socket.
+type muxConn struct {
+	s *muxSocket
+	// id is the Echo ID reserved for the trace, -1 if none.
+	id      int
+	packets chan packetInfo
+	// owner is protected by the mutex of the socket.
+	owner packetOwner
+
+	mu       sync.Mutex
+	hopLimit int
+	deadline time.Time
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// setOwner makes the packets owned by o dispatched to conn, if it is shared
+// through a Mux.
+func setOwner(conn packetConn, o packetOwner) {
+	c, ok := conn.(*muxConn)
+	if !ok {
+		return
+	}
+	c.s.mu.Lock()
+	c.owner = o
+	c.s.mu.Unlock()
+}
+
+func (c *muxConn) echoID() int {
+	return c.id
+}
+
+func (c *muxConn) SetHopLimit(hoplim int) error {
+	c.mu.Lock()
+	c.hopLimit = hoplim
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *muxConn) Write(b []byte, dst net.Addr) (int, error) {
+	if _, err := c.writeTimed(b, dst); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeTimed takes the send time once the other traces are done writing.
+func (c *muxConn) writeTimed(b []byte, dst net.Addr) (time.Time, error) {
+	select {
+	case <-c.done:
+		return time.Time{}, c.err
+	default:
+	}
+	c.mu.Lock()
+	hopLimit := c.hopLimit
+	c.mu.Unlock()
+	c.s.wmu.Lock()
+	defer c.s.wmu.Unlock()
+	if hopLimit > 0 {
+		if err := c.s.conn.SetHopLimit(hopLimit); err != nil {
+			return time.Time{}, err
+		}
+	}
+	start := time.Now()
+	_, err := c.s.conn.Write(b, dst)
+	return start, err
+}
+
+// Read is not supported, packets of shared sockets are read parsed.
+func (c *muxConn) Read(b []byte) (n int, src net.Addr, err error) {
+	return 0, nil, &Error{Kind: ErrUnsupported, Op: "read from shared connection"}
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// readPacket returns the next packet dispatched to the trace.
+func (c *muxConn) readPacket() (packetInfo, error) {
+	select {
+	case <-c.done:
+		return packetInfo{}, c.err
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-c.packets:
+		return p, nil
+	case <-timeout:
+		return packetInfo{}, os.ErrDeadlineExceeded
+	case <-c.done:
+		return packetInfo{}, c.err
+	}
+}
+
+// Close releases the Echo ID of the trace and closes the shared socket if no
+// other trace uses it.
+func (c *muxConn) Close() error {
+	m := c.s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.close(errMuxConnClosed)
+	c.s.mu.Lock()
+	open := c.s.conns[c]
+	delete(c.s.conns, c)
+	last := len(c.s.conns) == 0
+	c.s.mu.Unlock()
+	if !open {
+		return nil
+	}
+	if c.id >= 0 {
+		delete(m.echoIDs, c.id)
+	}
+	if !last {
+		return nil
+	}
+	if m.sockets[c.s.key] == c.s {
+		delete(m.sockets, c.s.key)
+	}
+	return c.s.conn.Close()
+}
+
+func (c *muxConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
@@ -0,0 +1,145 @@
+//go:build !windows
+// +build !windows
+
+package traceroute
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestMuxConcurrentTraces(t *testing.T) {
+	var m Mux
+	shared := newChanPacketConn()
+	router := &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	dest := net.IPv4(203, 0, 113, 1)
+	shared.script = func(ttl int, b []byte) {
+		msg, err := icmp.ParseMessage(protocolICMP, b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		echo := msg.Body.(*icmp.Echo)
+		if ttl < 2 {
+			shared.reads <- readAction{packet: ipv4TimeExceededPacket(echo.ID, echo.Seq), addr: router}
+			return
+		}
+		shared.reads <- readAction{packet: ipv4EchoReplyPacket(echo.ID, echo.Seq), addr: &net.IPAddr{IP: dest}}
+	}
+	key := muxKey{network: "icmp", family: 4}
+	opened := 0
+	newConn := func() (packetConn, error) {
+		opened++
+		return shared, nil
+	}
+
+	const traces = 4
+	tr := &Tracer{MaxHops: 5, Probes: 3, HopTimeout: time.Second}
+	cfg := tr.traceConfig(dest)
+	conns := make([]*muxConn, traces)
+	ids := map[int]bool{}
+	for i := range conns {
+		c, err := m.conn(key, newConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c
+		ids[c.echoID()] = true
+	}
+	if opened != 1 {
+		t.Errorf("socket opened %d times, want 1", opened)
+	}
+	if len(ids) != traces {
+		t.Errorf("Echo IDs = %v, want %d distinct ones", ids, traces)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]Hop, traces)
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c *muxConn) {
+			defer wg.Done()
+			pr := newICMPProber(cfg, nil, dest, c)
+			setOwner(c, pr)
+			res, err := tr.traceWithProber(context.Background(), cfg, nil, nil, c, pr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = res.Hops
+		}(i, c)
+	}
+	wg.Wait()
+	for i, hops := range results {
+		if len(hops) != 2 {
+			t.Errorf("trace %d: %d hops, want 2", i, len(hops))
+			continue
+		}
+		for _, h := range hops {
+			if len(h.Info) != 3 {
+				t.Errorf("trace %d hop %d: %d replies, want 3", i, h.Seq, len(h.Info))
+			}
+			for _, info := range h.Info {
+				if info.RTT < 0 {
+					t.Errorf("trace %d hop %d: probe lost", i, h.Seq)
+				}
+			}
+		}
+	}
+
+	for i, c := range conns {
+		c.Close()
+		select {
+		case <-shared.closed:
+			if i < traces-1 {
+				t.Fatalf("socket closed with %d traces left", traces-1-i)
+			}
+		default:
+			if i == traces-1 {
+				t.Fatal("socket left open")
+			}
+		}
+	}
+	if len(m.sockets) != 0 || len(m.echoIDs) != 0 {
+		t.Errorf("Mux not released: %d sockets, %d Echo IDs", len(m.sockets), len(m.echoIDs))
+	}
+}
+
+func TestMuxConnReadDeadline(t *testing.T) {
+	var m Mux
+	shared := newChanPacketConn()
+	c, err := m.conn(muxKey{network: "icmp", family: 4}, func() (packetConn, error) {
+		return shared, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setOwner(c, &icmpProber{family: 4, wmb: &icmp.Echo{ID: c.echoID()}})
+	// Not owned, dropped.
+	shared.reads <- readAction{packet: ipv4EchoReplyPacket(c.echoID()+1, 1)}
+	shared.reads <- readAction{packet: ipv4EchoReplyPacket(c.echoID(), 1)}
+	if err := c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPacket(c, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != c.echoID() || icmpType(4, p.Reply.Type) != ipv4.ICMPTypeEchoReply {
+		t.Errorf("read %+v, want the echo reply of the trace", p)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := readPacket(c, 4); !isTimeout(err) {
+		t.Errorf("read error = %v, want a timeout", err)
+	}
+	c.Close()
+	if _, err := readPacket(c, 4); err == nil || isTimeout(err) {
+		t.Errorf("read error after Close = %v, want closed", err)
+	}
+}
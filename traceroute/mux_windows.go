@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package traceroute
+
+// Mux shares raw sockets among the Tracers and Pingers using it. The ICMP
+// API used on Windows has no sockets to share, a Mux does nothing there.
+type Mux struct{}
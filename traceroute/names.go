@@ -0,0 +1,107 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLookupTimeout is the default timeout of each reverse DNS lookup done
+// by a NameResolver.
+const DefaultLookupTimeout = 2 * time.Second
+
+// NameResolver resolves the names of hop addresses with reverse DNS lookups.
+// Lookups run in parallel and their results, failures included, are cached.
+// A NameResolver can be shared by several Tracers.
+type NameResolver struct {
+	// Resolver is the resolver used for lookups, net.DefaultResolver if nil.
+	Resolver *net.Resolver
+	// Timeout bounds each lookup. It defaults to DefaultLookupTimeout.
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	names map[string]*nameLookup
+}
+
+type nameLookup struct {
+	done chan struct{}
+	name string
+}
+
+// LookupAddr returns the name of ip, or an empty string if it has none, the
+// lookup failed or ctx is done first.
+func (r *NameResolver) LookupAddr(ctx context.Context, ip net.IP) string {
+	l := r.lookup(ip)
+	select {
+	case <-l.done:
+		return l.name
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+// ResolveHops sets the Name of all the samples of hops.
+func (r *NameResolver) ResolveHops(ctx context.Context, hops []Hop) {
+	// Start all the lookups before waiting for any.
+	for _, h := range hops {
+		for _, info := range h.Info {
+			if info.IP != nil {
+				r.lookup(info.IP)
+			}
+		}
+	}
+	for _, h := range hops {
+		for i := range h.Info {
+			if ip := h.Info[i].IP; ip != nil {
+				h.Info[i].Name = r.LookupAddr(ctx, ip)
+			}
+		}
+	}
+}
+
+// cachedName returns the name of ip if it is already resolved, and starts
+// resolving it otherwise.
+func (r *NameResolver) cachedName(ip net.IP) string {
+	l := r.lookup(ip)
+	select {
+	case <-l.done:
+		return l.name
+	default:
+		return ""
+	}
+}
+
+// lookup returns the lookup of ip, starting it if needed.
+func (r *NameResolver) lookup(ip net.IP) *nameLookup {
+	addr := ip.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, found := r.names[addr]; found {
+		return l
+	}
+	if r.names == nil {
+		r.names = map[string]*nameLookup{}
+	}
+	l := &nameLookup{done: make(chan struct{})}
+	r.names[addr] = l
+	go func() {
+		defer close(l.done)
+		resolver := r.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = DefaultLookupTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		names, err := resolver.LookupAddr(ctx, addr)
+		if err == nil && len(names) > 0 {
+			l.name = strings.TrimSuffix(names[0], ".")
+		}
+	}()
+	return l
+}
@@ -0,0 +1,106 @@
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakePTRResolver returns a resolver answering PTR queries from names over
+// an in-memory stream connection. Queries for other addresses never get an
+// answer.
+func fakePTRResolver(names map[string]string, queries *int32) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveFakePTR(server, names, queries)
+			return client, nil
+		},
+	}
+}
+
+func serveFakePTR(conn net.Conn, names map[string]string, queries *int32) {
+	defer conn.Close()
+	for {
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil || len(q.Questions) != 1 {
+			return
+		}
+		atomic.AddInt32(queries, 1)
+		name, found := names[q.Questions[0].Name.String()]
+		if !found {
+			continue
+		}
+		r := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Questions[0].Name,
+					Type:  dnsmessage.TypePTR,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(name)},
+			}},
+		}
+		rb, err := r.Pack()
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(l[:], uint16(len(rb)))
+		if _, err := conn.Write(append(l[:], rb...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestNameResolver(t *testing.T) {
+	var queries int32
+	r := &NameResolver{
+		Resolver: fakePTRResolver(map[string]string{
+			"1.2.0.192.in-addr.arpa.": "router.example.net.",
+		}, &queries),
+		Timeout: 100 * time.Millisecond,
+	}
+	hops := []Hop{
+		{Seq: 1, Info: []HopInfo{{IP: net.IPv4(192, 0, 2, 1)}, {RTT: -1}, {IP: net.IPv4(192, 0, 2, 1)}}},
+		{Seq: 2, Info: []HopInfo{{IP: net.IPv4(192, 0, 2, 2)}}},
+	}
+	r.ResolveHops(context.Background(), hops)
+	if got, want := hops[0].Info[0].Name, "router.example.net"; got != want {
+		t.Errorf("hop 1 name = %q, want %q", got, want)
+	}
+	if got, want := hops[0].Info[2].Name, "router.example.net"; got != want {
+		t.Errorf("hop 1 second sample name = %q, want %q", got, want)
+	}
+	if got := hops[1].Info[0].Name; got != "" {
+		t.Errorf("hop 2 name = %q, want none after timeout", got)
+	}
+	if got, want := hops[0].String(), "  1 router.example.net (192.0.2.1)    0ms   *     0ms"; got != want {
+		t.Errorf("hop 1 String() = %q, want %q", got, want)
+	}
+
+	n := atomic.LoadInt32(&queries)
+	if got := r.LookupAddr(context.Background(), net.IPv4(192, 0, 2, 1)); got != "router.example.net" {
+		t.Errorf("LookupAddr() = %q, want cached name", got)
+	}
+	if got := atomic.LoadInt32(&queries); got != n {
+		t.Errorf("queries = %d after cached lookup, want %d", got, n)
+	}
+}
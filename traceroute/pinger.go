@@ -0,0 +1,163 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPingCount    = 5
+	DefaultPingInterval = time.Second
+	DefaultPingTTL      = 64
+)
+
+// Pinger sends ICMP Echo requests to a destination at a regular interval,
+// like ping does.
+type Pinger struct {
+	// Count is the number of requests sent. It defaults to
+	// DefaultPingCount.
+	Count int
+	// Interval is the time between two requests. It defaults to
+	// DefaultPingInterval.
+	Interval time.Duration
+	// Timeout is how long replies are waited for after the last request is
+	// sent. It defaults to DefaultHopTimeout.
+	Timeout time.Duration
+	// PacketSize is the size of the data of the requests. It defaults to
+	// DefaultPacketSize.
+	PacketSize uint16
+	// TTL is the TTL or hop limit of the requests. It defaults to
+	// DefaultPingTTL.
+	TTL int
+	// Source and Interface bind the requests like they do for a Tracer.
+	Source    net.IP
+	Interface string
+	// Mux, if set, shares raw sockets like it does for a Tracer.
+	Mux *Mux
+}
+
+// PingStats summarizes the replies to the requests of a Pinger.
+type PingStats struct {
+	HopStats
+	// Duplicates is the number of extra replies received for requests
+	// already answered. They are never detected on Windows.
+	Duplicates int `json:",omitempty"`
+	// RTTs holds the RTT of each request, in order, -1 for unanswered
+	// ones.
+	RTTs []time.Duration
+}
+
+func (s PingStats) String() string {
+	r := []string{fmt.Sprintf("%d/%d received, %.0f%% loss", s.Received, s.Sent, s.Loss*100)}
+	if s.Received > 0 {
+		r = append(r, fmt.Sprintf("min/avg/max/stddev %s/%s/%s/%s, jitter %s",
+			roundRTT(s.Min), roundRTT(s.Avg), roundRTT(s.Max), roundRTT(s.StdDev), roundRTT(s.Jitter)))
+	}
+	if s.Duplicates > 0 {
+		r = append(r, fmt.Sprintf("%d duplicates", s.Duplicates))
+	}
+	return strings.Join(r, ", ")
+}
+
+func roundRTT(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// pingConfig is the configuration of a Pinger with defaults applied.
+type pingConfig struct {
+	family     int
+	count      int
+	interval   time.Duration
+	timeout    time.Duration
+	packetSize int
+	ttl        int
+	bind       binding
+	mux        *Mux
+}
+
+func (p *Pinger) config(dest net.IP) pingConfig {
+	cfg := pingConfig{
+		family:     traceFamily(dest),
+		count:      p.Count,
+		interval:   p.Interval,
+		timeout:    p.Timeout,
+		packetSize: int(p.PacketSize),
+		ttl:        p.TTL,
+		bind:       binding{src: p.Source, iface: p.Interface},
+		mux:        p.Mux,
+	}
+	if cfg.count <= 0 {
+		cfg.count = DefaultPingCount
+	}
+	if cfg.interval <= 0 {
+		cfg.interval = DefaultPingInterval
+	}
+	if cfg.timeout <= 0 {
+		cfg.timeout = DefaultHopTimeout
+	}
+	if cfg.packetSize == 0 {
+		cfg.packetSize = DefaultPacketSize
+	}
+	if cfg.ttl <= 0 {
+		cfg.ttl = DefaultPingTTL
+	}
+	return cfg
+}
+
+// Ping sends Count requests to dest and returns the statistics of their
+// replies. It returns early with an error if ctx is done.
+func (p *Pinger) Ping(ctx context.Context, dest net.IP) (*PingStats, error) {
+	cfg := p.config(dest)
+	rtts, dups, err := p.ping(ctx, cfg, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &PingStats{HopStats: rttStats(rtts), Duplicates: dups, RTTs: rtts}, nil
+}
+
+// pingReplies records the replies to the requests of a Pinger.
+type pingReplies struct {
+	sent []time.Time
+	rtts []time.Duration
+	dups int
+	// pending is the number of requests sent and not answered yet.
+	pending int
+}
+
+func newPingReplies(count int) *pingReplies {
+	r := &pingReplies{
+		sent: make([]time.Time, count),
+		rtts: make([]time.Duration, count),
+	}
+	for i := range r.rtts {
+		r.rtts[i] = -1
+	}
+	return r
+}
+
+// send records that request i was sent at t.
+func (r *pingReplies) send(i int, t time.Time) {
+	r.sent[i] = t
+	r.pending++
+}
+
+// receive records a reply to request i received at t.
+func (r *pingReplies) receive(i int, t time.Time) {
+	if i < 0 || i >= len(r.sent) || r.sent[i].IsZero() {
+		return
+	}
+	if r.rtts[i] >= 0 {
+		r.dups++
+		return
+	}
+	r.rtts[i] = t.Sub(r.sent[i])
+	if r.rtts[i] < 0 {
+		// The wall clock kernel timestamps are taken from was stepped
+		// back.
+		r.rtts[i] = 0
+	}
+	r.pending--
+}
@@ -0,0 +1,40 @@
+package traceroute
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPingReplies(t *testing.T) {
+	ms := time.Millisecond
+	start := time.Unix(0, 0)
+	r := newPingReplies(4)
+	r.send(0, start)
+	r.send(1, start.Add(ms))
+	r.send(2, start.Add(2*ms))
+	r.receive(1, start.Add(11*ms))
+	r.receive(0, start.Add(12*ms))
+	r.receive(1, start.Add(13*ms)) // duplicate
+	r.receive(3, start.Add(14*ms)) // not sent
+	r.receive(-1, start.Add(15*ms))
+	if want := []time.Duration{12 * ms, 10 * ms, -1, -1}; !reflect.DeepEqual(r.rtts, want) {
+		t.Errorf("rtts = %v, want %v", r.rtts, want)
+	}
+	if r.dups != 1 || r.pending != 1 {
+		t.Errorf("dups, pending = %d, %d, want 1, 1", r.dups, r.pending)
+	}
+}
+
+func TestPingStatsString(t *testing.T) {
+	ms := time.Millisecond
+	s := PingStats{HopStats: rttStats([]time.Duration{10 * ms, -1, 30 * ms, 20 * ms}), Duplicates: 2}
+	want := "3/4 received, 25% loss, min/avg/max/stddev 10ms/20ms/30ms/8.16ms, jitter 15ms, 2 duplicates"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	s = PingStats{HopStats: rttStats([]time.Duration{-1})}
+	if got, want := s.String(), "0/1 received, 100% loss"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+func (p *Pinger) ping(ctx context.Context, cfg pingConfig, dest net.IP) ([]time.Duration, int, error) {
+	s, err := newSession(traceConfig{family: cfg.family, packetSize: cfg.packetSize, method: MethodICMP, bind: cfg.bind, mux: cfg.mux}, dest)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer s.Close()
+	defer closeOnDone(ctx, s.conn)()
+	return pingWithConn(ctx, cfg, s.conn, s.pr.(*icmpProber))
+}
+
+// pingWithConn sends the requests with pr while reading their replies from
+// conn in the background. conn must be closed once done for the reading
+// goroutine to return.
+func pingWithConn(ctx context.Context, cfg pingConfig, conn packetConn, pr *icmpProber) ([]time.Duration, int, error) {
+	var mu sync.Mutex
+	replies := newPingReplies(cfg.count)
+	received := make(chan struct{}, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			p, err := readPacket(conn, cfg.family)
+			if err != nil {
+				var e *Error
+				if errors.As(err, &e) && e.Kind == ErrParse {
+					continue
+				}
+				readErr <- err
+				return
+			}
+			if !p.Valid || !isICMPEchoReply(icmpType(cfg.family, p.Reply.Type)) {
+				// Errors are left to traceroute.
+				continue
+			}
+			id := probeID{seq: uint16(p.Seq) - pr.seq}
+			if !pr.match(p, id) {
+				continue
+			}
+			mu.Lock()
+			replies.receive(int(id.seq), p.Received)
+			mu.Unlock()
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	fail := func(err error) ([]time.Duration, int, error) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, 0, canceledError(ctxErr)
+		}
+		var e *Error
+		if !errors.As(err, &e) {
+			err = socketError("cannot read packet", err)
+		}
+		return nil, 0, err
+	}
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for i := 0; i < cfg.count; i++ {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case err := <-readErr:
+				return fail(err)
+			case <-ctx.Done():
+				return nil, 0, canceledError(ctx.Err())
+			}
+		}
+		mu.Lock()
+		start, err := pr.send(cfg.ttl, probeID{seq: uint16(i)})
+		if err == nil {
+			replies.send(i, start)
+		}
+		mu.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	timeout := time.NewTimer(cfg.timeout)
+	defer timeout.Stop()
+wait:
+	for {
+		mu.Lock()
+		pending := replies.pending
+		mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-received:
+		case <-timeout.C:
+			break wait
+		case err := <-readErr:
+			return fail(err)
+		case <-ctx.Done():
+			return nil, 0, canceledError(ctx.Err())
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]time.Duration(nil), replies.rtts...), replies.dups, nil
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+package traceroute
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ping sends the requests one after the other as the ICMP API waits for the
+// reply of each, so a request is delayed by the replies to the previous one
+// taking longer than the interval and duplicates are not seen.
+func (p *Pinger) ping(ctx context.Context, cfg pingConfig, dest net.IP) ([]time.Duration, int, error) {
+	wt, err := newWindowsTracer(cfg.family, cfg.packetSize, cfg.bind)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer wt.Close()
+	rtts := make([]time.Duration, cfg.count)
+	start := time.Now()
+	for i := range rtts {
+		if i > 0 {
+			t := time.NewTimer(time.Until(start.Add(time.Duration(i) * cfg.interval)))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, 0, canceledError(ctx.Err())
+			}
+		}
+		info, _, err := wt.probe(ctx, cfg.ttl, dest, cfg.timeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		rtts[i] = -1
+		if info.Reply != nil && isICMPEchoReply(icmpType(cfg.family, info.Reply.Type)) {
+			rtts[i] = info.RTT
+		}
+	}
+	return rtts, 0, nil
+}
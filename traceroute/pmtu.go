@@ -0,0 +1,222 @@
+package traceroute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// minMTU4 and minMTU6 are the minimum MTUs of IPv4 (RFC 791) and IPv6
+	// (RFC 8200) links, where path MTU discovery starts from.
+	minMTU4 = 68
+	minMTU6 = 1280
+	// defaultMTU is the upper bound of the search when the MTU of the
+	// interface the probes are sent on is unknown.
+	defaultMTU = 1500
+	// maxMTU is the size of the largest packet probes can be.
+	maxMTU = 65535
+)
+
+// PMTU is the outcome of a path MTU discovery.
+type PMTU struct {
+	// MTU is the size of the largest packet, IP header included, which
+	// reached the destination. It is zero if none did.
+	MTU int
+	// LocalMTU is the MTU of the interface the probes were sent on, the
+	// largest size tried.
+	LocalMTU int
+	// TooBig lists the Fragmentation Needed and Packet Too Big errors the
+	// probes triggered.
+	TooBig []TooBig `json:",omitempty"`
+	// Blackhole is set if probes larger than MTU were dropped without any
+	// error telling so, which breaks path MTU discovery and typically
+	// stalls connections exchanging large packets like DoH and DoT.
+	Blackhole bool `json:",omitempty"`
+}
+
+// TooBig is a Fragmentation Needed or Packet Too Big error.
+type TooBig struct {
+	// Size is the size of the probe which triggered the error.
+	Size int
+	// Router is the address of the router which sent the error, nil if the
+	// probe was refused by the local host.
+	Router net.IP `json:",omitempty"`
+	// MTU is the next-hop MTU advertised by the router, zero if none.
+	MTU int `json:",omitempty"`
+}
+
+func (tb TooBig) String() string {
+	from := "local host"
+	if tb.Router != nil {
+		from = tb.Router.String()
+	}
+	if tb.MTU == 0 {
+		return fmt.Sprintf("%d bytes too big for %s", tb.Size, from)
+	}
+	return fmt.Sprintf("%d bytes too big for %s (MTU %d)", tb.Size, from, tb.MTU)
+}
+
+func (p PMTU) String() string {
+	if p.MTU == 0 {
+		return "destination unreachable"
+	}
+	s := []string{fmt.Sprintf("%d bytes", p.MTU)}
+	if p.MTU < p.LocalMTU {
+		s[0] += fmt.Sprintf(" (local MTU %d)", p.LocalMTU)
+	}
+	for _, tb := range p.TooBig {
+		s = append(s, tb.String())
+	}
+	if p.Blackhole {
+		s = append(s, "larger packets dropped silently")
+	}
+	return strings.Join(s, ", ")
+}
+
+// pmtuProbeFunc sends a probe of the given size, IP header included, which
+// must not be fragmented, and waits for its reply until timeout.
+type pmtuProbeFunc func(size int, timeout time.Duration) (HopInfo, error)
+
+// PMTU discovers the path MTU toward dest by sending ICMP Echo requests
+// which must not be fragmented (with the DF bit for IPv4), searching for the
+// size of the largest one reaching dest. Up to Probes requests are sent per
+// size before giving up on it, with at most MaxHops hops and waiting
+// HopTimeout for replies. It is not supported on Windows for IPv6.
+func (t *Tracer) PMTU(ctx context.Context, dest net.IP) (*PMTU, error) {
+	cfg := t.traceConfig(dest)
+	var err error
+	if cfg.bind, err = cfg.bind.forFamily(cfg.family); err != nil {
+		return nil, err
+	}
+	probe, close, err := t.openPMTUProbe(ctx, cfg, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+	lo := minMTU4
+	if cfg.family == 6 {
+		lo = minMTU6
+	}
+	return discoverPMTU(ctx, cfg, lo, interfaceMTU(cfg.family, dest, cfg.bind), probe)
+}
+
+// discoverPMTU binary searches the path MTU between lo and hi, jumping to
+// the MTU advertised by Too Big errors when they do.
+func discoverPMTU(ctx context.Context, cfg traceConfig, lo, hi int, probe pmtuProbeFunc) (*PMTU, error) {
+	r := &PMTU{LocalMTU: hi}
+	// lost is the smallest size for which all probes were lost.
+	lost := 0
+	// try returns whether a probe of the given size reached the
+	// destination, or the MTU advertised in the error it triggered.
+	try := func(size int) (reached bool, mtu int, err error) {
+		for i := 0; i < cfg.probes; i++ {
+			if err := ctx.Err(); err != nil {
+				return false, 0, canceledError(err)
+			}
+			info, err := probe(size, cfg.hopTimeout)
+			if err != nil {
+				return false, 0, err
+			}
+			switch {
+			case info.Reply == nil:
+				// Lost, try again.
+				continue
+			case info.Reply.Type == int(ipv4.ICMPTypeEchoReply) && info.Reply.Proto == "icmp",
+				info.Reply.Type == int(ipv6.ICMPTypeEchoReply) && info.Reply.Proto == "icmpv6":
+				return true, 0, nil
+			case info.Reply.Proto == "icmp" && isICMPTooBig(ipv4.ICMPType(info.Reply.Type), info.Reply.Code),
+				info.Reply.Proto == "icmpv6" && isICMPTooBig(ipv6.ICMPType(info.Reply.Type), info.Reply.Code):
+				r.TooBig = append(r.TooBig, TooBig{Size: size, Router: info.IP, MTU: info.Reply.MTU})
+				return false, info.Reply.MTU, nil
+			default:
+				// Any other error, the destination is not reachable
+				// with this size either.
+				return false, 0, nil
+			}
+		}
+		if lost == 0 || size < lost {
+			lost = size
+		}
+		return false, 0, nil
+	}
+
+	reached, mtu, err := try(hi)
+	if err != nil {
+		return nil, err
+	}
+	if reached {
+		r.MTU = hi
+		return r, nil
+	}
+	if hi > lo {
+		if reached, _, err = try(lo); err != nil {
+			return nil, err
+		}
+	}
+	if !reached {
+		// Unreachable regardless of the size.
+		return r, nil
+	}
+	for hi-lo > 1 {
+		size := lo + (hi-lo)/2
+		if mtu > lo && mtu < hi {
+			// Packets larger than the advertised MTU are too big for
+			// the router, and hopefully it is the only one limiting.
+			size = mtu
+			hi = mtu + 1
+		}
+		if reached, mtu, err = try(size); err != nil {
+			return nil, err
+		}
+		if reached {
+			lo = size
+		} else {
+			hi = size
+		}
+	}
+	r.MTU = lo
+	r.Blackhole = lost > r.MTU
+	return r, nil
+}
+
+// interfaceMTU returns the MTU of the interface used to reach dest, or
+// defaultMTU if unknown.
+func interfaceMTU(family int, dest net.IP, b binding) int {
+	src, err := sourceAddr(family, dest, b)
+	if err != nil {
+		return defaultMTU
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return defaultMTU
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(src) && iface.MTU > 0 {
+				if iface.MTU > maxMTU {
+					return maxMTU
+				}
+				return iface.MTU
+			}
+		}
+	}
+	return defaultMTU
+}
+
+// pmtuOverhead returns the size of the IP and ICMP headers of probes.
+func pmtuOverhead(family int) int {
+	if family == 6 {
+		return ipv6.HeaderLen + 8
+	}
+	return ipv4.HeaderLen + 8
+}
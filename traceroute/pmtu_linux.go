@@ -0,0 +1,34 @@
+package traceroute
+
+import (
+	"os"
+	"syscall"
+)
+
+// dontFragment makes conn send packets with the DF bit set for IPv4 and
+// never fragment them, even above the path MTU known by the system, so that
+// they probe it instead.
+func dontFragment(conn packetConn, family int) error {
+	sc, ok := conn.(syscallConner)
+	if !ok {
+		return &Error{Kind: ErrUnsupported, Op: "path MTU discovery"}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return socketError("cannot access socket", err)
+	}
+	level, opt, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE
+	if family == 6 {
+		level, opt, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return socketError("cannot access socket", err)
+	}
+	if serr != nil {
+		return socketError("cannot disable fragmentation", os.NewSyscallError("setsockopt", serr))
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package traceroute
+
+func dontFragment(conn packetConn, family int) error {
+	return &Error{Kind: ErrUnsupported, Op: "path MTU discovery"}
+}
@@ -0,0 +1,123 @@
+package traceroute
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pmtuTestLink is a link of a path, limiting the size of the packets
+// crossing it.
+type pmtuTestLink struct {
+	mtu int
+	// router sends the Too Big errors, if set.
+	router net.IP
+	// report is the MTU advertised in the errors.
+	report int
+}
+
+// pmtuTestPath returns a pmtuProbeFunc probing a path made of links, and
+// the sizes it was called with.
+func pmtuTestPath(links []pmtuTestLink) (pmtuProbeFunc, *[]int) {
+	var sizes []int
+	return func(size int, timeout time.Duration) (HopInfo, error) {
+		sizes = append(sizes, size)
+		for _, l := range links {
+			if size <= l.mtu {
+				continue
+			}
+			if l.router == nil {
+				return HopInfo{RTT: -1}, nil
+			}
+			return HopInfo{IP: l.router, RTT: time.Millisecond, Reply: &Reply{Proto: "icmp", Type: 3, Code: 4, MTU: l.report}}, nil
+		}
+		return HopInfo{IP: net.IPv4(203, 0, 113, 1), RTT: time.Millisecond, Reply: &Reply{Proto: "icmp"}}, nil
+	}, &sizes
+}
+
+func TestDiscoverPMTU(t *testing.T) {
+	r1 := net.IPv4(192, 0, 2, 1)
+	r2 := net.IPv4(192, 0, 2, 2)
+	tests := []struct {
+		name  string
+		links []pmtuTestLink
+		want  PMTU
+		// probes is the number of probes sent.
+		probes int
+	}{
+		{
+			"no limit",
+			nil,
+			PMTU{MTU: 1500, LocalMTU: 1500},
+			1,
+		},
+		{
+			"reported",
+			[]pmtuTestLink{{1400, r1, 1400}},
+			PMTU{MTU: 1400, LocalMTU: 1500, TooBig: []TooBig{{Size: 1500, Router: r1, MTU: 1400}}},
+			3,
+		},
+		{
+			"two routers",
+			[]pmtuTestLink{{1480, r1, 1480}, {1420, r2, 1420}},
+			PMTU{MTU: 1420, LocalMTU: 1500, TooBig: []TooBig{
+				{Size: 1500, Router: r1, MTU: 1480},
+				{Size: 1480, Router: r2, MTU: 1420},
+			}},
+			4,
+		},
+		{
+			"without MTU",
+			[]pmtuTestLink{{1400, r1, 0}},
+			PMTU{MTU: 1400, LocalMTU: 1500},
+			0,
+		},
+		{
+			"blackhole",
+			[]pmtuTestLink{{1450, nil, 0}},
+			PMTU{MTU: 1450, LocalMTU: 1500, Blackhole: true},
+			0,
+		},
+		{
+			"unreachable",
+			[]pmtuTestLink{{0, nil, 0}},
+			PMTU{LocalMTU: 1500},
+			4,
+		},
+	}
+	cfg := traceConfig{family: 4, probes: 2, hopTimeout: time.Second}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, sizes := pmtuTestPath(tt.links)
+			got, err := discoverPMTU(context.Background(), cfg, minMTU4, 1500, probe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.TooBig == nil {
+				// Only check the size found.
+				got.TooBig = nil
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("discoverPMTU() = %+v, want %+v", *got, tt.want)
+			}
+			if tt.probes > 0 && len(*sizes) != tt.probes {
+				t.Errorf("probes = %v, want %d", *sizes, tt.probes)
+			}
+		})
+	}
+}
+
+func TestPMTUString(t *testing.T) {
+	p := PMTU{
+		MTU:       1400,
+		LocalMTU:  1500,
+		TooBig:    []TooBig{{Size: 1500, Router: net.IPv4(192, 0, 2, 1), MTU: 1400}, {Size: 1450}},
+		Blackhole: true,
+	}
+	want := "1400 bytes (local MTU 1500), 1500 bytes too big for 192.0.2.1 (MTU 1400), 1450 bytes too big for local host, larger packets dropped silently"
+	if got := p.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// openPMTUProbe opens an ICMP socket sending packets which must not be
+// fragmented and returns the function sending probes of a given size on it.
+// The returned close function must be called once done.
+func (t *Tracer) openPMTUProbe(ctx context.Context, cfg traceConfig, dest net.IP) (probe pmtuProbeFunc, close func(), err error) {
+	cfg.method = MethodICMP
+	cfg.paris = false
+	// Packets are sent with DF set on the socket, it cannot be shared.
+	cfg.mux = nil
+	s, err := newSession(cfg, dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := dontFragment(s.conn, cfg.family); err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	done := closeOnDone(ctx, s.conn)
+	pr := s.pr.(*icmpProber)
+	var seq uint16
+	return func(size int, timeout time.Duration) (HopInfo, error) {
+			pr.wmb.Data = make([]byte, size-pmtuOverhead(cfg.family))
+			results, err := t.probe(ctx, s.conn, cfg.family, pr, []int{cfg.maxHops}, []probeID{{seq: seq}}, timeout, nil)
+			seq++
+			if errors.Is(err, syscall.EMSGSIZE) {
+				// Too big for the local interface.
+				typ, code := 3, 4
+				if cfg.family == 6 {
+					typ, code = 2, 0
+				}
+				return HopInfo{RTT: -1, Reply: &Reply{Proto: icmpProtoName(cfg.family), Type: typ, Code: code}}, nil
+			}
+			if err != nil {
+				return HopInfo{}, err
+			}
+			return results[0].info, nil
+		}, func() {
+			done()
+			_ = s.Close()
+		}, nil
+}
@@ -0,0 +1,176 @@
+package traceroute
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Behaviors of hops explaining their loss or latency without a forwarding
+// problem.
+const (
+	// NoteControlPlane is loss or latency of a hop not found on the hops
+	// past it: the router forwards traffic fine but generates its ICMP
+	// replies slowly or drops them, replies being handled by its control
+	// plane at a low priority.
+	NoteControlPlane = "control-plane"
+	// NoteRateLimit is control plane loss matching a token bucket limiting
+	// the ICMP replies of a hop: a burst of probes is answered until the
+	// bucket is empty, then replies come back once per refill interval. It
+	// requires the send times of enough probes, as sent by a Monitor.
+	NoteRateLimit = "rate-limit"
+)
+
+// controlPlaneDelay is the RTT a hop must have above the hops past it for
+// its latency to be reported, lower differences being left to jitter.
+const controlPlaneDelay = 10 * time.Millisecond
+
+// HopNote tells that the loss or latency of a hop does not affect the
+// traffic it forwards.
+type HopNote struct {
+	// Note is one of the Note constants.
+	Note string
+	Hop  int
+	IP   net.IP `json:",omitempty"`
+	// Loss is the loss of the hop and ExtraRTT its median RTT above the
+	// lowest one of the hops past it, if reported.
+	Loss     float64       `json:",omitempty"`
+	ExtraRTT time.Duration `json:",omitempty"`
+}
+
+func (n HopNote) String() string {
+	var sb strings.Builder
+	if n.IP == nil {
+		fmt.Fprintf(&sb, "%s at hop %d", n.Note, n.Hop)
+	} else {
+		fmt.Fprintf(&sb, "%s at hop %d (%s)", n.Note, n.Hop, n.IP)
+	}
+	var details []string
+	if n.Loss > 0 {
+		details = append(details, fmt.Sprintf("%.0f%% loss", n.Loss*100))
+	}
+	if n.ExtraRTT > 0 {
+		details = append(details, fmt.Sprintf("+%s RTT", roundRTT(n.ExtraRTT)))
+	}
+	if len(details) > 0 {
+		fmt.Fprintf(&sb, ": %s", strings.Join(details, ", "))
+	}
+	return sb.String()
+}
+
+// HopNotes returns the hops replying to some of their probes with loss or
+// latency which do not affect forwarding as they are not found on the hops
+// past them, telling ICMP rate limiting apart from the send times of the
+// samples. The last hop replying is never noted for its loss.
+func HopNotes(hops []Hop) []HopNote {
+	stats := make([]HopStats, len(hops))
+	for i, h := range hops {
+		stats[i] = h.Stats()
+	}
+	var notes []HopNote
+	for i, h := range hops {
+		s := stats[i]
+		if s.Received == 0 {
+			continue
+		}
+		// The lowest loss and median RTT of the hops past h, which its
+		// forwarding problems would add to.
+		downLoss, downRTT, down := 1.0, time.Duration(0), false
+		for _, d := range stats[i+1:] {
+			if d.Received == 0 {
+				continue
+			}
+			if !down || d.Loss < downLoss {
+				downLoss = d.Loss
+			}
+			if !down || d.Median < downRTT {
+				downRTT = d.Median
+			}
+			down = true
+		}
+		n := HopNote{Hop: h.Seq}
+		if ips := h.IPs(); len(ips) > 0 {
+			n.IP = ips[0]
+		}
+		// The loss of the last hop replying, usually the destination, is
+		// never known not to affect forwarding.
+		if down && s.Loss > downLoss {
+			n.Note, n.Loss = NoteControlPlane, s.Loss
+			if rateLimited(h.Info) {
+				n.Note = NoteRateLimit
+			}
+		}
+		if down && s.Median-downRTT > controlPlaneDelay {
+			if n.Note == "" {
+				n.Note = NoteControlPlane
+			}
+			n.ExtraRTT = s.Median - downRTT
+		}
+		if n.Note != "" {
+			notes = append(notes, n)
+		}
+	}
+	return notes
+}
+
+// rateLimitSamples is the number of samples of a hop needed to tell a token
+// bucket from random loss.
+const rateLimitSamples = 6
+
+// rateLimited tells whether the replies to the probes of a hop, in the order
+// they were sent, match a token bucket: a burst of probes answered until it
+// is empty, then probes lost until a token is added, replies coming back
+// once per refill interval. The interval is estimated as the shortest time
+// between replies past the burst. Probes of the burst must have been sent
+// faster than that, and every lost probe within that time of the previous
+// reply, which random loss seldom does once at least two replies came back
+// after losses. Samples without a send time are never rate limited.
+func rateLimited(infos []HopInfo) bool {
+	if len(infos) < rateLimitSamples || infos[0].RTT < 0 {
+		return false
+	}
+	for _, info := range infos {
+		if info.Sent.IsZero() {
+			return false
+		}
+	}
+	burst := 1
+	for burst < len(infos) && infos[burst].RTT >= 0 {
+		burst++
+	}
+	if burst == len(infos) {
+		return false
+	}
+	// refill is the shortest time between replies past the burst.
+	var refill time.Duration
+	recovered := 0
+	last := infos[burst-1].Sent
+	for _, info := range infos[burst:] {
+		if info.RTT < 0 {
+			continue
+		}
+		if d := info.Sent.Sub(last); recovered == 0 || d < refill {
+			refill = d
+		}
+		last = info.Sent
+		recovered++
+	}
+	if recovered < 2 {
+		return false
+	}
+	for i := 1; i < burst; i++ {
+		if infos[i].Sent.Sub(infos[i-1].Sent) >= refill {
+			return false
+		}
+	}
+	last = infos[burst-1].Sent
+	for _, info := range infos[burst:] {
+		if info.RTT >= 0 {
+			last = info.Sent
+		} else if info.Sent.Sub(last) >= refill {
+			return false
+		}
+	}
+	return true
+}
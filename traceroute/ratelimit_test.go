@@ -0,0 +1,150 @@
+package traceroute
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timedInfos returns samples sent at the given seconds, one per second if
+// none, answered for each ! of replies and lost for each dot.
+func timedInfos(replies string, at ...int) []HopInfo {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	infos := make([]HopInfo, len(replies))
+	for i, c := range replies {
+		sent := start.Add(time.Duration(i) * time.Second)
+		if at != nil {
+			sent = start.Add(time.Duration(at[i]) * time.Second)
+		}
+		infos[i] = HopInfo{RTT: -1, Sent: sent}
+		if c == '!' {
+			infos[i].RTT = 3 * time.Millisecond
+		}
+	}
+	return infos
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		name  string
+		infos []HopInfo
+		want  bool
+	}{
+		{"no loss", timedInfos("!!!!!!"), false},
+		{"steady refill", timedInfos("!!!..!..!..!."), true},
+		{"uneven probes", timedInfos("!!!.!.!..!", 0, 1, 2, 3, 5, 6, 8, 9, 10, 12), true},
+		{"too few samples", timedInfos("!.!.!"), false},
+		{"single refill", timedInfos("!!!.....!"), false},
+		{"empty at first", timedInfos("..!..!..!"), false},
+		{"random loss", timedInfos("!!.!!!.!!"), false},
+		{"irregular refills", timedInfos("!.!....!.!"), false},
+		{"failure after refills", timedInfos("!.!.!......"), false},
+		{"slow burst", timedInfos("!!!.!.!", 0, 10, 20, 21, 22, 23, 24), false},
+		{"no send times", []HopInfo{{RTT: 1}, {RTT: -1}, {RTT: -1}, {RTT: 1}, {RTT: -1}, {RTT: -1}, {RTT: 1}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rateLimited(tt.infos); got != tt.want {
+				t.Errorf("rateLimited() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// notesHop returns hop seq replying from 192.0.2.seq with the given RTTs in
+// milliseconds, -1 for lost probes, sent one per second.
+func notesHop(seq int, rtts ...int) Hop {
+	h := Hop{Seq: seq, Info: timedInfos(strings.Repeat(".", len(rtts)))}
+	for i, rtt := range rtts {
+		if rtt >= 0 {
+			h.Info[i].IP, h.Info[i].RTT = net.IPv4(192, 0, 2, byte(seq)), time.Duration(rtt)*time.Millisecond
+		}
+	}
+	return h
+}
+
+// patternHop returns hop seq replying from 192.0.2.seq to probes sent one
+// per second, answered for each ! of replies and lost for each dot.
+func patternHop(seq int, replies string) Hop {
+	h := Hop{Seq: seq, Info: timedInfos(replies)}
+	for i := range h.Info {
+		if h.Info[i].RTT >= 0 {
+			h.Info[i].IP = net.IPv4(192, 0, 2, byte(seq))
+		}
+	}
+	return h
+}
+
+func TestHopNotes(t *testing.T) {
+	ip := func(seq int) net.IP { return net.IPv4(192, 0, 2, byte(seq)) }
+	tests := []struct {
+		name string
+		hops []Hop
+		want []HopNote
+	}{
+		{"clean", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, 5, 6, 5),
+		}, nil},
+		{"control plane loss", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, -1, 3, 3),
+			notesHop(3, 5, 6, 5),
+		}, []HopNote{{Note: NoteControlPlane, Hop: 2, IP: ip(2), Loss: 1.0 / 3}}},
+		{"forwarding loss", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, -1, 3, 3),
+			notesHop(3, -1, 5, 5),
+		}, nil},
+		{"too few samples for a rate limit", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, 3, -1, -1),
+			notesHop(3, 5, 6, 5),
+		}, []HopNote{{Note: NoteControlPlane, Hop: 2, IP: ip(2), Loss: 2.0 / 3}}},
+		{"rate limit", []Hop{
+			patternHop(1, "!!!!!!!!!!"),
+			patternHop(2, "!!!..!..!."),
+			patternHop(3, "!!!!!!!!!!"),
+		}, []HopNote{{Note: NoteRateLimit, Hop: 2, IP: ip(2), Loss: 0.5}}},
+		{"rate limited destination", []Hop{
+			patternHop(1, "!!!!!!!!!!"),
+			patternHop(2, "!!!..!..!."),
+		}, nil},
+		{"forwarding loss matching a rate limit", []Hop{
+			patternHop(1, "!!!!!!!!!!"),
+			patternHop(2, "!!!..!..!."),
+			patternHop(3, "!!!..!..!."),
+		}, nil},
+		{"destination loss", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, -1, 5, 5),
+		}, nil},
+		{"control plane latency", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, 40, 60, 50),
+			notesHop(3, -1),
+			notesHop(4, 10, 12, 11),
+		}, []HopNote{{Note: NoteControlPlane, Hop: 2, IP: ip(2), ExtraRTT: 39 * time.Millisecond}}},
+		{"forwarding latency", []Hop{
+			notesHop(1, 1, 1, 1),
+			notesHop(2, 40, 60, 50),
+			notesHop(3, 45, 52, 50),
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HopNotes(tt.hops); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HopNotes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHopNoteString(t *testing.T) {
+	n := HopNote{Note: NoteControlPlane, Hop: 2, IP: net.IPv4(192, 0, 2, 2), Loss: 0.5, ExtraRTT: 20 * time.Millisecond}
+	if got, want := n.String(), "control-plane at hop 2 (192.0.2.2): 50% loss, +20ms RTT"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
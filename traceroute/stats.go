@@ -0,0 +1,93 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// HopStats summarizes the samples of a hop. RTT statistics only account for
+// answered probes and are zero if none was.
+type HopStats struct {
+	Sent     int
+	Received int
+	// Loss is the ratio of unanswered probes, between 0 and 1.
+	Loss   float64
+	Min    time.Duration
+	Avg    time.Duration
+	Max    time.Duration
+	Median time.Duration
+	StdDev time.Duration
+	// Jitter is the mean absolute difference between the RTTs of
+	// consecutive answered probes.
+	Jitter time.Duration
+}
+
+// Stats computes the statistics of the hop samples.
+func (h Hop) Stats() HopStats {
+	rtts := make([]time.Duration, len(h.Info))
+	for i, info := range h.Info {
+		rtts[i] = info.RTT
+	}
+	return rttStats(rtts)
+}
+
+// rttStats computes the statistics of the RTTs of consecutive probes,
+// negative for unanswered ones.
+func rttStats(all []time.Duration) HopStats {
+	s := HopStats{Sent: len(all)}
+	rtts := make([]time.Duration, 0, len(all))
+	for _, rtt := range all {
+		if rtt >= 0 {
+			rtts = append(rtts, rtt)
+		}
+	}
+	s.Received = len(rtts)
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	if len(rtts) == 0 {
+		return s
+	}
+
+	var sum, jitter time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			jitter += d
+		}
+	}
+	s.Avg = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		s.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+	var variance float64
+	for _, rtt := range rtts {
+		d := float64(rtt - s.Avg)
+		variance += d * d
+	}
+	s.StdDev = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	s.Min, s.Max = rtts[0], rtts[len(rtts)-1]
+	if n := len(rtts); n%2 == 1 {
+		s.Median = rtts[n/2]
+	} else {
+		s.Median = (rtts[n/2-1] + rtts[n/2]) / 2
+	}
+	return s
+}
+
+// MarshalJSON includes the hop statistics along with its samples.
+func (h Hop) MarshalJSON() ([]byte, error) {
+	type hop Hop
+	return json.Marshal(struct {
+		hop
+		Stats HopStats
+	}{hop(h), h.Stats()})
+}
@@ -0,0 +1,83 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHopStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want HopStats
+	}{
+		{"no samples", nil, HopStats{}},
+		{"all lost", []time.Duration{-1, -1}, HopStats{Sent: 2, Loss: 1}},
+		{
+			"odd",
+			[]time.Duration{10 * ms, -1, 30 * ms, 20 * ms},
+			HopStats{
+				Sent:     4,
+				Received: 3,
+				Loss:     0.25,
+				Min:      10 * ms,
+				Avg:      20 * ms,
+				Max:      30 * ms,
+				Median:   20 * ms,
+				StdDev:   8164965,
+				Jitter:   15 * ms,
+			},
+		},
+		{
+			"even",
+			[]time.Duration{10 * ms, 20 * ms},
+			HopStats{
+				Sent:     2,
+				Received: 2,
+				Min:      10 * ms,
+				Avg:      15 * ms,
+				Max:      20 * ms,
+				Median:   15 * ms,
+				StdDev:   5 * ms,
+				Jitter:   10 * ms,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Hop
+			for _, rtt := range tt.rtts {
+				h.Info = append(h.Info, HopInfo{RTT: rtt})
+			}
+			if got := h.Stats(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHopMarshalJSON(t *testing.T) {
+	h := Hop{Seq: 1, Info: []HopInfo{{RTT: time.Millisecond}, {RTT: -1}}}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Seq   int
+		Info  []HopInfo
+		Stats HopStats
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq != 1 || len(got.Info) != 2 || got.Stats.Received != 1 || got.Stats.Loss != 0.5 {
+		t.Fatalf("json.Marshal() = %s", b)
+	}
+	var back Hop
+	if err := json.Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back, h) {
+		t.Fatalf("json.Unmarshal() = %+v, %v, want %+v", back, err, h)
+	}
+}
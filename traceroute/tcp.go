@@ -0,0 +1,64 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	// tcpMSS is the maximum segment size option advertised in probes, some
+	// middleboxes drop SYN segments without options.
+	tcpMSS = 1460
+)
+
+type tcpHeader struct {
+	SrcPort int
+	DstPort int
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+}
+
+// parseTCPHeader parses the beginning of a TCP header. Only the first 8
+// bytes (ports and sequence number) are required as ICMP errors are not
+// guaranteed to quote more, Ack and Flags are left to zero when missing.
+func parseTCPHeader(b []byte) (tcpHeader, bool) {
+	if len(b) < 8 {
+		return tcpHeader{}, false
+	}
+	h := tcpHeader{
+		SrcPort: int(binary.BigEndian.Uint16(b[0:2])),
+		DstPort: int(binary.BigEndian.Uint16(b[2:4])),
+		Seq:     binary.BigEndian.Uint32(b[4:8]),
+	}
+	if len(b) >= 14 {
+		h.Ack = binary.BigEndian.Uint32(b[8:12])
+		h.Flags = b[13]
+	}
+	return h, true
+}
+
+// marshalTCPSYN returns a TCP SYN segment with a MSS option. The checksum is
+// computed for the given source and destination addresses, which must both
+// be 4 or 16 bytes long.
+func marshalTCPSYN(src, dst net.IP, srcPort, dstPort int, seq uint32) []byte {
+	b := make([]byte, tcpHeaderLen+4)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = byte(len(b)/4) << 4
+	b[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(b[14:16], 0xffff) // window
+	b[20], b[21] = 2, 4                          // MSS option
+	binary.BigEndian.PutUint16(b[22:24], tcpMSS)
+	s := pseudoHeaderSum(src, dst, protocolTCP, len(b))
+	binary.BigEndian.PutUint16(b[16:18], ^checksumFold(checksumAdd(s, b)))
+	return b
+}
@@ -0,0 +1,22 @@
+package traceroute
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMarshalTCPSYN(t *testing.T) {
+	src := net.IPv4(192, 0, 2, 1).To4()
+	dst := net.IPv4(45, 90, 28, 0).To4()
+	b := marshalTCPSYN(src, dst, 40000, 443, 0x01020304)
+	h, ok := parseTCPHeader(b)
+	if !ok {
+		t.Fatal("parseTCPHeader() ok = false")
+	}
+	if got, want := h, (tcpHeader{SrcPort: 40000, DstPort: 443, Seq: 0x01020304, Flags: tcpFlagSYN}); got != want {
+		t.Fatalf("header = %+v, want %+v", got, want)
+	}
+	if got := checksumFold(checksumAdd(pseudoHeaderSum(src, dst, protocolTCP, len(b)), b)); got != 0xffff {
+		t.Fatalf("checksum does not verify: sum = %#04x", got)
+	}
+}
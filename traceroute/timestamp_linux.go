@@ -0,0 +1,84 @@
+package traceroute
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// enableTimestamps makes the kernel report the time packets are received at
+// on c with SO_TIMESTAMPNS. It is best effort, the time packets are read at
+// is used otherwise.
+func enableTimestamps(c syscall.Conn) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = raw.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// parseTimestamp returns the receive time found in the control messages oob,
+// or the zero time.
+func parseTimestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SCM_TIMESTAMPNS {
+			continue
+		}
+		var ts syscall.Timespec
+		if len(m.Data) < int(unsafe.Sizeof(ts)) {
+			continue
+		}
+		ts = *(*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		return time.Unix(ts.Unix())
+	}
+	return time.Time{}
+}
+
+func (p packetConn4) readStamped(b []byte) (n int, src net.Addr, ttl int, at time.Time, err error) {
+	return readMsg(4, p.c, b)
+}
+
+func (p packetConn6) readStamped(b []byte) (n int, src net.Addr, ttl int, at time.Time, err error) {
+	return readMsg(6, p.c, b)
+}
+
+// readMsg reads a packet on the raw socket c along with its TTL and the time
+// it was received at, x/net not exposing the timestamp control message.
+func readMsg(family int, c net.PacketConn, b []byte) (n int, src net.Addr, ttl int, at time.Time, err error) {
+	ipc, ok := c.(*net.IPConn)
+	if !ok {
+		n, src, err = c.ReadFrom(b)
+		return n, src, 0, time.Time{}, err
+	}
+	oob := make([]byte, 512)
+	n, oobn, _, addr, err := ipc.ReadMsgIP(b, oob)
+	if err != nil {
+		return 0, nil, 0, time.Time{}, err
+	}
+	if family == 4 {
+		// Unlike ReadFrom, ReadMsgIP leaves the IPv4 header of raw
+		// sockets.
+		n = stripIPv4Header(b[:n])
+	}
+	return n, addr, parseTTL(family, oob[:oobn]), parseTimestamp(oob[:oobn]), nil
+}
+
+// stripIPv4Header removes the IPv4 header at the start of b and returns the
+// length of the payload left at its place.
+func stripIPv4Header(b []byte) int {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return len(b)
+	}
+	l := int(b[0]&0x0f) << 2
+	if l < 20 || l > len(b) {
+		return len(b)
+	}
+	return copy(b, b[l:])
+}
@@ -0,0 +1,37 @@
+package traceroute
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Unix(1700000000, 123456789)
+	ts := syscall.NsecToTimespec(want.UnixNano())
+	data := (*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:]
+	oob := append(controlMessage(syscall.IPPROTO_IP, syscall.IP_TTL, []byte{57, 0, 0, 0}),
+		controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPNS, data)...)
+	if got := parseTimestamp(oob); !got.Equal(want) {
+		t.Errorf("parseTimestamp() = %v, want %v", got, want)
+	}
+	if got := parseTTL(4, oob); got != 57 {
+		t.Errorf("parseTTL() = %d, want 57", got)
+	}
+	if got := parseTimestamp(oob[:syscall.CmsgSpace(4)]); !got.IsZero() {
+		t.Errorf("parseTimestamp() without timestamp = %v, want zero", got)
+	}
+}
+
+func TestStripIPv4Header(t *testing.T) {
+	payload := []byte{11, 0, 0xf4, 0xff}
+	b := append([]byte{0x46, 0, 0, 28, 0, 0, 0, 0, 64, 1, 0, 0, 192, 0, 2, 1, 192, 0, 2, 2, 1, 1, 1, 1}, payload...)
+	if n := stripIPv4Header(b); !bytes.Equal(b[:n], payload) {
+		t.Errorf("stripIPv4Header() = %v, want %v", b[:n], payload)
+	}
+	if n := stripIPv4Header(payload); n != len(payload) {
+		t.Errorf("stripIPv4Header() of a payload = %d bytes, want it left as is", n)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package traceroute
+
+import "syscall"
+
+// enableTimestamps does nothing, packets are timestamped when read.
+func enableTimestamps(c syscall.Conn) {}
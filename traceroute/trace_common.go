@@ -3,6 +3,7 @@ package traceroute
 import (
 	"context"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -12,9 +13,28 @@ type traceConfig struct {
 	maxHops    int
 	hopTimeout time.Duration
 	probes     int
+	method     Method
+	port       int
+	paris      bool
+	window     int
+	firstTTL   int
+	gapLimit   int
+	timeout    time.Duration
+	bind       binding
+	class      trafficClass
+	mux        *Mux
 }
 
-type probeFunc func(ttl int, timeout time.Duration) (HopInfo, bool, error)
+type probeResult struct {
+	info HopInfo
+	// last is true if the reply comes from the destination.
+	last bool
+}
+
+// batchProbeFunc sends a probe for each of ttls and calls result with the
+// index of the probe in ttls as soon as its outcome is known, whatever the
+// order. Probes past the destination may be left without a result.
+type batchProbeFunc func(ttls []int, timeout time.Duration, result func(i int, r probeResult)) error
 
 func (t *Tracer) traceConfig(dest net.IP) traceConfig {
 	packetSize := int(t.PacketSize)
@@ -33,12 +53,47 @@ func (t *Tracer) traceConfig(dest net.IP) traceConfig {
 	if probes == 0 {
 		probes = DefaultProbes
 	}
+	window := t.Window
+	if window <= 0 || window > maxHops {
+		window = maxHops
+	}
+	firstTTL := t.FirstTTL
+	if firstTTL <= 0 {
+		firstTTL = 1
+	}
+	if firstTTL > maxHops {
+		firstTTL = maxHops
+	}
+	class := trafficClass{tos: t.TOS, flowLabel: t.FlowLabel}
+	family := traceFamily(dest)
+	if family != 6 {
+		class.flowLabel = 0
+	}
+	port := t.Port
+	if port == 0 {
+		switch {
+		case t.Method == MethodTCP:
+			port = DefaultTCPPort
+		case t.Method == MethodUDP && t.Paris:
+			port = DefaultUDPPort
+		}
+	}
 	return traceConfig{
-		family:     traceFamily(dest),
+		family:     family,
 		packetSize: packetSize,
 		maxHops:    maxHops,
 		hopTimeout: hopTimeout,
 		probes:     probes,
+		method:     t.Method,
+		port:       port,
+		paris:      t.Paris,
+		window:     window,
+		firstTTL:   firstTTL,
+		gapLimit:   t.GapLimit,
+		timeout:    t.Timeout,
+		bind:       binding{src: t.Source, iface: t.Interface},
+		class:      class,
+		mux:        t.Mux,
 	}
 }
 
@@ -49,41 +104,285 @@ func traceFamily(dest net.IP) int {
 	return 6
 }
 
-func (t *Tracer) traceWithFunc(ctx context.Context, cfg traceConfig, c chan Hop, probe probeFunc) error {
+func (t *Tracer) trace(ctx context.Context, dest net.IP, c chan Hop, samples chan<- Sample) (*Result, error) {
+	cfg := t.traceConfig(dest)
+	probe, closeProbe, err := t.openProbe(ctx, cfg, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer closeProbe()
+	return t.traceWithFunc(ctx, cfg, c, samples, probe)
+}
+
+// traceWithFunc probes the hops from cfg.firstTTL in rounds. Each sample is
+// sent on samples as soon as it is known and each hop is sent on c, in
+// order, once all its probes are done. Either channel may be nil. The
+// consolidated hops are returned at the end along with the reason the trace
+// stopped, once all the samples and hops are received.
+func (t *Tracer) traceWithFunc(ctx context.Context, cfg traceConfig, c chan Hop, samples chan<- Sample, probe batchProbeFunc) (*Result, error) {
+	out := newTraceOutput(ctx, c, samples, t.Names)
+	defer out.abort()
 	hops := make([]Hop, cfg.maxHops)
 	for i := range hops {
 		hops[i].Seq = i + 1
 	}
+	var deadline time.Time
+	if cfg.timeout > 0 {
+		deadline = time.Now().Add(cfg.timeout)
+	}
 
-	lastHop := cfg.maxHops
-	complete := false
-	for round := 0; round < cfg.probes; round++ {
-		hopLimit := cfg.maxHops
-		if complete {
-			hopLimit = lastHop
+	stop := StopMaxHops
+	// lastHop is the last hop kept and probeHop the last one probed, lower
+	// than lastHop once the silent hops of a gap are found.
+	lastHop, probeHop := cfg.maxHops, cfg.maxHops
+	// probed is the last hop probed in the first round.
+	probed := cfg.firstTTL - 1
+	// checked is the number of hops checked for a gap and gap the number of
+	// consecutive silent ones among them.
+	checked, gap := cfg.firstTTL-1, 0
+	checkGap := func() {
+		for ; checked < probeHop && len(hops[checked].Info) > 0; checked++ {
+			if hops[checked].Info[0].IP != nil {
+				gap = 0
+				continue
+			}
+			if gap++; gap == cfg.gapLimit {
+				stop = StopGapLimit
+				lastHop = checked + 1
+				probeHop = lastHop - gap
+				return
+			}
+		}
+	}
+	// sent is the number of hops already sent on c or skipped.
+	sent := cfg.firstTTL - 1
+	send := func() {
+		out.hop(hops[sent])
+		sent++
+	}
+	flush := func() {
+		for c != nil && sent < lastHop && len(hops[sent].Info) == cfg.probes {
+			if cfg.gapLimit > 0 && stop != StopDestination && sent >= checked {
+				// It may be past a gap.
+				break
+			}
+			send()
 		}
-		for ttl := 1; ttl <= hopLimit; ttl++ {
+	}
+rounds:
+	for round := 0; round < cfg.probes; round++ {
+		for first := cfg.firstTTL; first <= probeHop; first += cfg.window {
 			if err := ctx.Err(); err != nil {
-				return err
+				return nil, canceledError(err)
+			}
+			timeout := cfg.hopTimeout
+			if !deadline.IsZero() {
+				left := time.Until(deadline)
+				if left <= 0 {
+					if stop == StopMaxHops {
+						stop = StopDeadline
+					}
+					break rounds
+				}
+				if left < timeout {
+					timeout = left
+				}
+			}
+			end := first + cfg.window - 1
+			if end > probeHop {
+				end = probeHop
+			}
+			if round == 0 {
+				probed = end
+			}
+			ttls := make([]int, 0, end-first+1)
+			for ttl := first; ttl <= end; ttl++ {
+				ttls = append(ttls, ttl)
 			}
-			info, last, err := probe(ttl, cfg.hopTimeout)
+			err := probe(ttls, timeout, func(i int, r probeResult) {
+				ttl := ttls[i]
+				if ttl > lastHop {
+					// Past the destination or a gap.
+					return
+				}
+				t.annotate(&r.info)
+				hops[ttl-1].Info = append(hops[ttl-1].Info, r.info)
+				if t.Names != nil && r.info.IP != nil {
+					// Start resolving the name early.
+					t.Names.lookup(r.info.IP)
+				}
+				if samples != nil {
+					out.sample(Sample{TTL: ttl, Last: r.last, HopInfo: r.info})
+				}
+				if r.last {
+					stop = StopDestination
+					lastHop, probeHop = ttl, ttl
+				}
+				if round == 0 && cfg.gapLimit > 0 && stop != StopDestination {
+					checkGap()
+				}
+				flush()
+			})
 			if err != nil {
-				return err
+				return nil, err
 			}
-			hops[ttl-1].Info = append(hops[ttl-1].Info, info)
-			if last {
-				complete = true
-				lastHop = ttl
-				break
+		}
+	}
+
+	if probed < lastHop {
+		lastHop = probed
+	}
+	hops = hops[:lastHop]
+	for c != nil && sent < len(hops) {
+		send()
+	}
+	if err := out.wait(); err != nil {
+		return nil, err
+	}
+	if t.Names != nil {
+		// Hops already sent are resolved and must not be modified.
+		t.Names.ResolveHops(ctx, hops[sent:])
+	}
+	return &Result{Hops: hops[cfg.firstTTL-1:], Stop: stop}, nil
+}
+
+// traceOutput sends the samples and hops of a trace on their channels from its
+// own goroutine, resolving the names of hops first, so that reading replies
+// never waits for receivers or lookups.
+type traceOutput struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	c       chan<- Hop
+	samples chan<- Sample
+	names   *NameResolver
+	// wake is signaled when the queue grows or is closed and done closed
+	// once the goroutine returns.
+	wake chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	queue  []traceEvent
+	closed bool
+
+	// err is set by the goroutine if ctx is done before all the events are
+	// sent.
+	err error
+}
+
+// traceEvent is a sample or a hop to send.
+type traceEvent struct {
+	sample Sample
+	hop    *Hop
+}
+
+func newTraceOutput(ctx context.Context, c chan<- Hop, samples chan<- Sample, names *NameResolver) *traceOutput {
+	o := &traceOutput{
+		c:       c,
+		samples: samples,
+		names:   names,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	o.ctx, o.cancel = context.WithCancel(ctx)
+	go o.run()
+	return o
+}
+
+// sample queues s to be sent on the samples channel.
+func (o *traceOutput) sample(s Sample) {
+	o.push(traceEvent{sample: s})
+}
+
+// hop queues h to be resolved and sent on the hops channel. The samples of h
+// must not be modified anymore except for their names.
+func (o *traceOutput) hop(h Hop) {
+	o.push(traceEvent{hop: &h})
+}
+
+func (o *traceOutput) push(e traceEvent) {
+	o.mu.Lock()
+	o.queue = append(o.queue, e)
+	o.mu.Unlock()
+	o.signal()
+}
+
+func (o *traceOutput) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *traceOutput) run() {
+	defer close(o.done)
+	for {
+		o.mu.Lock()
+		queue, closed := o.queue, o.closed
+		o.queue = nil
+		o.mu.Unlock()
+		for _, e := range queue {
+			if o.err = o.send(e); o.err != nil {
+				return
 			}
 		}
+		if closed {
+			return
+		}
+		select {
+		case <-o.wake:
+		case <-o.ctx.Done():
+			o.err = canceledError(o.ctx.Err())
+			return
+		}
 	}
+}
 
-	if complete {
-		hops = hops[:lastHop]
+func (o *traceOutput) send(e traceEvent) error {
+	if e.hop == nil {
+		select {
+		case o.samples <- e.sample:
+			return nil
+		case <-o.ctx.Done():
+			return canceledError(o.ctx.Err())
+		}
+	}
+	if o.names != nil {
+		o.names.ResolveHops(o.ctx, []Hop{*e.hop})
+	}
+	select {
+	case o.c <- *e.hop:
+		return nil
+	case <-o.ctx.Done():
+		return canceledError(o.ctx.Err())
+	}
+}
+
+// wait returns once all the queued events are sent, or with an error if
+// the context is done first.
+func (o *traceOutput) wait() error {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	o.signal()
+	<-o.done
+	return o.err
+}
+
+// abort stops sending events and returns once nothing is sent anymore.
+func (o *traceOutput) abort() {
+	o.cancel()
+	<-o.done
+}
+
+// annotate sets the AS and location of info from the Tracer databases.
+func (t *Tracer) annotate(info *HopInfo) {
+	if info.IP == nil {
+		return
+	}
+	if t.ASN != nil {
+		info.AS = t.ASN.Lookup(info.IP)
 	}
-	for _, hop := range hops {
-		c <- hop
+	if t.Geo != nil {
+		info.Location = t.Geo.Lookup(info.IP)
 	}
-	return nil
 }
@@ -0,0 +1,238 @@
+package traceroute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pathProbe returns a batchProbeFunc for a path on which the hops at the
+// TTLs of replying reply, the destination being the last one if reached.
+// Replies are reported before timeouts, like probe does. The TTLs of each
+// batch are appended to probed.
+func pathProbe(replying []int, reached bool, probed *[][]int) batchProbeFunc {
+	dest := 0
+	if reached {
+		dest = replying[len(replying)-1]
+	}
+	replies := map[int]bool{}
+	for _, ttl := range replying {
+		replies[ttl] = true
+	}
+	return func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		*probed = append(*probed, ttls)
+		for i, ttl := range ttls {
+			if replies[ttl] && (dest == 0 || ttl <= dest) {
+				result(i, probeResult{info: HopInfo{IP: net.IPv4(192, 0, 2, byte(ttl)), RTT: time.Millisecond}, last: ttl == dest})
+			}
+		}
+		for i, ttl := range ttls {
+			if !replies[ttl] && (dest == 0 || ttl < dest) {
+				result(i, probeResult{info: HopInfo{RTT: -1}})
+			}
+		}
+		return nil
+	}
+}
+
+func TestTraceWithFuncStops(t *testing.T) {
+	tests := []struct {
+		name     string
+		tracer   Tracer
+		replying []int
+		reached  bool
+		// wantProbed are the TTLs probed in each batch.
+		wantProbed [][]int
+		wantHops   []int
+		wantStop   StopReason
+	}{
+		{
+			name:       "destination",
+			tracer:     Tracer{MaxHops: 5, Probes: 2},
+			replying:   []int{1, 2, 3},
+			reached:    true,
+			wantProbed: [][]int{{1, 2, 3, 4, 5}, {1, 2, 3}},
+			wantHops:   []int{1, 2, 3},
+			wantStop:   StopDestination,
+		},
+		{
+			name:       "max hops",
+			tracer:     Tracer{MaxHops: 3, Probes: 1},
+			replying:   []int{1, 2, 3},
+			wantProbed: [][]int{{1, 2, 3}},
+			wantHops:   []int{1, 2, 3},
+			wantStop:   StopMaxHops,
+		},
+		{
+			name:       "first TTL",
+			tracer:     Tracer{MaxHops: 5, Probes: 2, FirstTTL: 3},
+			replying:   []int{1, 2, 3, 4},
+			reached:    true,
+			wantProbed: [][]int{{3, 4, 5}, {3, 4}},
+			wantHops:   []int{3, 4},
+			wantStop:   StopDestination,
+		},
+		{
+			name:       "gap limit",
+			tracer:     Tracer{MaxHops: 10, Probes: 2, Window: 2, GapLimit: 3},
+			replying:   []int{1, 2, 4, 8},
+			wantProbed: [][]int{{1, 2}, {3, 4}, {5, 6}, {7, 8}, {1, 2}, {3, 4}},
+			wantHops:   []int{1, 2, 3, 4, 5, 6, 7},
+			wantStop:   StopGapLimit,
+		},
+		{
+			name:       "gap limit all at once",
+			tracer:     Tracer{MaxHops: 10, Probes: 2, GapLimit: 3},
+			replying:   []int{1, 2, 8},
+			wantProbed: [][]int{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, {1, 2}},
+			wantHops:   []int{1, 2, 3, 4, 5},
+			wantStop:   StopGapLimit,
+		},
+		{
+			name:       "destination past a gap",
+			tracer:     Tracer{MaxHops: 10, Probes: 1, GapLimit: 2},
+			replying:   []int{1, 5},
+			reached:    true,
+			wantProbed: [][]int{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+			wantHops:   []int{1, 2, 3, 4, 5},
+			wantStop:   StopDestination,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := net.IPv4(203, 0, 113, 1)
+			var probed [][]int
+			c := make(chan Hop, tt.tracer.MaxHops)
+			res, err := tt.tracer.traceWithFunc(context.Background(), tt.tracer.traceConfig(dest), c, nil, pathProbe(tt.replying, tt.reached, &probed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(c)
+			if !reflect.DeepEqual(probed, tt.wantProbed) {
+				t.Errorf("probed %v, want %v", probed, tt.wantProbed)
+			}
+			var got, sent []int
+			for _, h := range res.Hops {
+				got = append(got, h.Seq)
+			}
+			for h := range c {
+				sent = append(sent, h.Seq)
+			}
+			if !reflect.DeepEqual(got, tt.wantHops) || !reflect.DeepEqual(sent, tt.wantHops) {
+				t.Errorf("hops %v, sent %v, want %v", got, sent, tt.wantHops)
+			}
+			if res.Stop != tt.wantStop {
+				t.Errorf("stop = %s, want %s", res.Stop, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestTraceWithFuncDeadline(t *testing.T) {
+	tr := Tracer{MaxHops: 10, Probes: 1, Window: 1, HopTimeout: time.Second, Timeout: 50 * time.Millisecond}
+	var timeouts []time.Duration
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		timeouts = append(timeouts, timeout)
+		time.Sleep(timeout)
+		result(0, probeResult{info: HopInfo{RTT: -1}})
+		return nil
+	}
+	res, err := tr.traceWithFunc(context.Background(), tr.traceConfig(net.IPv4(203, 0, 113, 1)), nil, nil, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stop != StopDeadline {
+		t.Errorf("stop = %s, want %s", res.Stop, StopDeadline)
+	}
+	if len(timeouts) == 0 || len(res.Hops) != len(timeouts) {
+		t.Fatalf("%d hops for %d batches", len(res.Hops), len(timeouts))
+	}
+	for _, d := range timeouts {
+		if d > tr.Timeout {
+			t.Errorf("batch timeout %s past the trace timeout %s", d, tr.Timeout)
+		}
+	}
+}
+
+func TestTraceWithFuncSlowReceivers(t *testing.T) {
+	tr := Tracer{MaxHops: 3, Probes: 2}
+	var probed [][]int
+	pp := pathProbe([]int{1, 2, 3}, true, &probed)
+	done := make(chan struct{})
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		err := pp(ttls, timeout, result)
+		if len(probed) == tr.Probes {
+			close(done)
+		}
+		return err
+	}
+	c, samples := make(chan Hop), make(chan Sample)
+	var hops, got int
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("probing waited for the receivers")
+		}
+		for hops < 3 || got < 6 {
+			select {
+			case <-c:
+				hops++
+			case <-samples:
+				got++
+			}
+		}
+	}()
+	if _, err := tr.traceWithFunc(context.Background(), tr.traceConfig(net.IPv4(203, 0, 113, 1)), c, samples, probe); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+}
+
+func TestTraceWithFuncCanceledReceiver(t *testing.T) {
+	tr := Tracer{MaxHops: 3, Probes: 1}
+	var probed [][]int
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := tr.traceWithFunc(ctx, tr.traceConfig(net.IPv4(203, 0, 113, 1)), make(chan Hop), nil, pathProbe([]int{1, 2, 3}, true, &probed))
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("traceWithFunc() error = %v, want ErrCanceled", err)
+	}
+}
+
+func TestTraceWithFuncResolvesOutsideProbes(t *testing.T) {
+	var queries int32
+	tr := Tracer{MaxHops: 3, Probes: 1, Names: &NameResolver{
+		// Hops past the first one never get an answer.
+		Resolver: fakePTRResolver(map[string]string{"1.2.0.192.in-addr.arpa.": "router.example.net."}, &queries),
+		Timeout:  200 * time.Millisecond,
+	}}
+	var probed [][]int
+	pp := pathProbe([]int{1, 2, 3}, true, &probed)
+	var probing time.Duration
+	probe := func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		start := time.Now()
+		defer func() { probing += time.Since(start) }()
+		return pp(ttls, timeout, result)
+	}
+	c := make(chan Hop, tr.MaxHops)
+	res, err := tr.traceWithFunc(context.Background(), tr.traceConfig(net.IPv4(192, 0, 2, 3)), c, nil, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probing >= tr.Names.Timeout {
+		t.Errorf("probing took %s, waiting for lookups", probing)
+	}
+	if got, want := res.Hops[0].Info[0].Name, "router.example.net"; got != want {
+		t.Errorf("hop 1 name = %q, want %q", got, want)
+	}
+	close(c)
+	if h := <-c; h.Info[0].Name != "router.example.net" {
+		t.Errorf("hop 1 sent with name %q", h.Info[0].Name)
+	}
+}
@@ -1,6 +1,7 @@
 package traceroute
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -12,13 +13,160 @@ const (
 	DefaultHopTimeout = 5 * time.Second
 	DefaultMaxHops    = 20
 	DefaultProbes     = 3
+	DefaultUDPPort    = 33434
+	DefaultTCPPort    = 443
 )
 
+// Method selects the kind of probe packets sent by a Tracer.
+type Method int
+
+const (
+	// MethodICMP sends ICMP Echo requests.
+	MethodICMP Method = iota
+	// MethodUDP sends UDP datagrams, to incrementing ports starting at
+	// DefaultUDPPort unless a fixed port is set.
+	MethodUDP
+	// MethodTCP sends TCP SYN segments, to DefaultTCPPort unless another
+	// port is set. A SYN-ACK or RST from the destination ends the trace.
+	MethodTCP
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodICMP:
+		return "icmp"
+	case MethodUDP:
+		return "udp"
+	case MethodTCP:
+		return "tcp"
+	default:
+		return fmt.Sprintf("method(%d)", int(m))
+	}
+}
+
 type Tracer struct {
 	PacketSize uint16
 	HopTimeout time.Duration
 	MaxHops    int
 	Probes     int
+	Method     Method
+
+	// Port is the destination port of UDP and TCP probes. When set for
+	// UDP, every probe is sent to this port (e.g. 53) and probes are told
+	// apart using their UDP checksum instead of their destination port.
+	Port int
+
+	// Paris keeps the fields load balancers hash on constant across all the
+	// probes of a trace, like Paris traceroute does, so that they all follow
+	// the same path: the ICMP checksum is kept constant by compensating the
+	// sequence number change in the payload, UDP probes are sent to a fixed
+	// port (DefaultUDPPort unless Port is set) and TCP probes from a fixed
+	// source port.
+	Paris bool
+
+	// Window is the number of consecutive TTLs probed at once, replies
+	// being matched to probes as they come back. It defaults to MaxHops so
+	// that each round of probes is sent all at once. On Windows, probes are
+	// always sent one at a time.
+	Window int
+
+	// FirstTTL is the TTL of the first hop probed, to skip the hops of the
+	// local network. It defaults to 1. PMTU ignores it.
+	FirstTTL int
+
+	// GapLimit, if set, stops a trace once that many consecutive hops did
+	// not reply to their first probe. The silent hops are kept in the
+	// result but not probed again. Multipath traces stop once that many
+	// consecutive TTLs did not reply to any flow. PMTU ignores it.
+	GapLimit int
+
+	// Timeout, if set, stops a trace after that long with the hops found
+	// so far. It is checked between batches of probes, waiting for the
+	// replies of a batch no longer than the time left. Multipath traces
+	// return the graph found so far. A Monitor and PMTU ignore it.
+	Timeout time.Duration
+
+	// Source, if set, is the local address probes are sent from. Tracing a
+	// destination of another family fails with ErrUnsupportedFamily.
+	Source net.IP
+
+	// Interface, if set, is the name of the network interface probes are
+	// sent on, to test one uplink of a multi-homed host. On Linux, sockets
+	// are bound to it with SO_BINDTODEVICE. Elsewhere, its address is used
+	// as Source instead if that is unset.
+	Interface string
+
+	// TOS is the TOS byte of IPv4 probes or the traffic class of IPv6
+	// ones: the DSCP in the upper 6 bits and the ECN in the lower 2. Some
+	// networks route or police packets differently depending on it.
+	TOS int
+
+	// FlowLabel is the flow label of IPv6 probes, the system picking one if
+	// zero. It is only supported on Linux.
+	FlowLabel int
+
+	// Mux, if set, shares raw sockets with the other Tracers and Pingers
+	// using it, to run many traces at once. It is ignored on Windows.
+	Mux *Mux
+
+	// Names, if set, is used to resolve the names of the hops. Hops sent on
+	// the channel and returned have their names set while Samples do not.
+	Names *NameResolver
+
+	// ASN, if set, is used to annotate hops and samples with the AS
+	// announcing their address.
+	ASN *ASNDB
+
+	// Geo, if set, is used to annotate hops and samples with the location
+	// of their address.
+	Geo *GeoDB
+}
+
+// Trace traces the route to dest, sending each hop on c, in order, as soon
+// as all its probes are done. Probing goes on while c is not received from,
+// and Trace returns once all the hops are received or ctx is done.
+func (t *Tracer) Trace(ctx context.Context, dest net.IP, c chan Hop) error {
+	_, err := t.trace(ctx, dest, c, nil)
+	return err
+}
+
+// TraceResult is like Trace but also returns the consolidated hops and why
+// the trace stopped. c may be nil.
+func (t *Tracer) TraceResult(ctx context.Context, dest net.IP, c chan Hop) (*Result, error) {
+	return t.trace(ctx, dest, c, nil)
+}
+
+// TraceSamples traces the route to dest, sending the outcome of each probe on
+// c as soon as it is known, and returns the consolidated hops once done and
+// all the samples are received. Probing goes on while c is not received from.
+func (t *Tracer) TraceSamples(ctx context.Context, dest net.IP, c chan<- Sample) ([]Hop, error) {
+	res, err := t.trace(ctx, dest, nil, c)
+	if err != nil {
+		return nil, err
+	}
+	return res.Hops, nil
+}
+
+// StopReason tells why a trace stopped.
+type StopReason string
+
+const (
+	// StopDestination is a trace which reached its destination.
+	StopDestination StopReason = "destination"
+	// StopMaxHops is a trace which probed up to MaxHops without reaching
+	// its destination.
+	StopMaxHops StopReason = "max-hops"
+	// StopGapLimit is a trace stopped after GapLimit silent hops.
+	StopGapLimit StopReason = "gap-limit"
+	// StopDeadline is a trace stopped after its Timeout.
+	StopDeadline StopReason = "deadline"
+)
+
+// Result is the outcome of a trace.
+type Result struct {
+	// Hops are the hops probed, from FirstTTL on.
+	Hops []Hop
+	Stop StopReason
 }
 
 // Hop represents a network hop in a traceroute result
@@ -36,7 +184,21 @@ func (h Hop) String() string {
 			sb.WriteString(", ")
 		}
 		first = false
-		fmt.Fprintf(&sb, "%14s", ip.String())
+		if name := h.Name(ip); name != "" {
+			fmt.Fprintf(&sb, "%s (%s)", name, ip)
+		} else {
+			fmt.Fprintf(&sb, "%14s", ip.String())
+		}
+		var notes []string
+		if as := h.AS(ip); as != nil {
+			notes = append(notes, fmt.Sprintf("AS%d", as.Number))
+		}
+		if l := h.Location(ip); l != nil {
+			notes = append(notes, l.String())
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(notes, " "))
+		}
 	}
 	if first {
 		sb.WriteString("               ")
@@ -50,6 +212,10 @@ func (h Hop) String() string {
 			fmt.Fprintf(&sb, " %3dms", rtt/time.Millisecond)
 		}
 	}
+	for _, line := range h.extensionLines() {
+		sb.WriteString("\n      ")
+		sb.WriteString(line)
+	}
 	return sb.String()
 }
 
@@ -74,6 +240,36 @@ func (h Hop) IPs() []net.IP {
 	return ips
 }
 
+// Name returns the name of ip among the hop samples, if resolved.
+func (h Hop) Name(ip net.IP) string {
+	for _, hop := range h.Info {
+		if hop.Name != "" && ip.Equal(hop.IP) {
+			return hop.Name
+		}
+	}
+	return ""
+}
+
+// AS returns the AS announcing ip among the hop samples, if known.
+func (h Hop) AS(ip net.IP) *ASInfo {
+	for _, hop := range h.Info {
+		if hop.AS != nil && ip.Equal(hop.IP) {
+			return hop.AS
+		}
+	}
+	return nil
+}
+
+// Location returns the location of ip among the hop samples, if known.
+func (h Hop) Location(ip net.IP) *Location {
+	for _, hop := range h.Info {
+		if hop.Location != nil && ip.Equal(hop.IP) {
+			return hop.Location
+		}
+	}
+	return nil
+}
+
 func (h Hop) RTTs() []time.Duration {
 	var rtts []time.Duration
 	for _, hop := range h.Info {
@@ -85,4 +281,82 @@ func (h Hop) RTTs() []time.Duration {
 type HopInfo struct {
 	IP  net.IP
 	RTT time.Duration
+	// Name is the reverse DNS name of IP, if resolved.
+	Name string `json:",omitempty"`
+	// AS is the AS announcing IP, if known.
+	AS *ASInfo `json:",omitempty"`
+	// Location is the location of IP, if known.
+	Location *Location `json:",omitempty"`
+	// MPLS is the label stack quoted by the router and Interfaces the
+	// interfaces it identifies, from the extensions of its ICMP error. They
+	// are not available on Windows.
+	MPLS       []MPLSLabel     `json:",omitempty"`
+	Interfaces []InterfaceInfo `json:",omitempty"`
+	// Reply describes the packet received, nil if none.
+	Reply *Reply `json:",omitempty"`
+	// Modifications lists how the probe was modified on its way to the
+	// hop, as told by the header it quotes. They are not detected with
+	// unprivileged ICMP sockets and on Windows.
+	Modifications []string `json:",omitempty"`
+	// Clock is the Clock constant telling how RTT was measured, empty for
+	// lost probes.
+	Clock string `json:",omitempty"`
+	// Sent is the time the probe was sent at, left out of the JSON of the
+	// hop.
+	Sent time.Time `json:"-"`
+}
+
+// Clocks measuring the RTT of probes.
+const (
+	// ClockKernel is the time the reply was received at by the kernel,
+	// reported with SO_TIMESTAMPNS on Linux.
+	ClockKernel = "kernel"
+	// ClockUser is the time the reply was read at by the process, later
+	// on busy hosts.
+	ClockUser = "user"
+	// ClockSystem is the RTT measured by the ICMP API of Windows, with a
+	// millisecond resolution.
+	ClockSystem = "system"
+)
+
+// Reply describes the packet received in reply to a probe.
+type Reply struct {
+	// Proto is the protocol of the reply: icmp, icmpv6 or tcp.
+	Proto string
+	// Type and Code are the ICMP type and code of the reply, zero for TCP.
+	Type int
+	Code int
+	// TTL is the TTL or hop limit the reply was received with, from which
+	// the length of the return path can be estimated. It is zero if
+	// unknown, always the case on Windows.
+	TTL int `json:",omitempty"`
+	// QuotedTTL is the TTL or hop limit of the probe as quoted in ICMP
+	// errors, normally 1 for Time Exceeded messages. It is zero if unknown,
+	// always the case with unprivileged ICMP sockets and on Windows.
+	QuotedTTL int `json:",omitempty"`
+	// MTU is the MTU of the next hop given by Fragmentation Needed and
+	// Packet Too Big errors. It is zero if unknown.
+	MTU int `json:",omitempty"`
+	// QuotedTOS is the TOS or traffic class of the probe as quoted in ICMP
+	// errors, which tells whether it was rewritten on the way, like
+	// cleared by DSCP bleaching. It is nil if unknown.
+	QuotedTOS *int `json:",omitempty"`
+	// QuotedFlowLabel is the IPv6 flow label of the probe as quoted in
+	// ICMP errors. It is zero if unknown.
+	QuotedFlowLabel int `json:",omitempty"`
+}
+
+// setQuoted sets the fields of r describing the quoted probe from q.
+func (r *Reply) setQuoted(q Reply) {
+	r.QuotedTTL, r.QuotedTOS, r.QuotedFlowLabel = q.QuotedTTL, q.QuotedTOS, q.QuotedFlowLabel
+}
+
+// Sample is the outcome of a single probe sent with the given TTL.
+type Sample struct {
+	TTL int
+	// Last is true if the reply comes from the destination. As TTLs are
+	// probed concurrently, the destination may reply to several of them
+	// while only the lowest one ends up in the consolidated hops.
+	Last bool
+	HopInfo
 }
@@ -5,55 +5,200 @@ package traceroute
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"os"
 	"time"
 
 	"golang.org/x/net/icmp"
 )
 
 type packetInfo struct {
-	Seq   int
-	ID    int
-	Peer  net.Addr
-	Last  bool
-	Valid bool
+	// Proto is the protocol of the probe the packet relates to. For UDP
+	// probes, ID and Seq are the source and destination ports.
+	Proto    int
+	Seq      int
+	ID       int
+	Checksum uint16
+	TCPSeq   uint32
+	Peer     net.Addr
+	Last     bool
+	Valid    bool
+	// MPLS and Interfaces are parsed from the extensions of ICMP errors.
+	MPLS       []MPLSLabel
+	Interfaces []InterfaceInfo
+	// Received is the time the packet was received at, told by Clock.
+	Received time.Time
+	Clock    string
+	// Reply describes the packet itself.
+	Reply Reply
+	// Quote is the header of the probe quoted in ICMP errors.
+	Quote *quotedHeader
 }
 
-func (t *Tracer) Trace(ctx context.Context, dest net.IP, c chan Hop) error {
-	cfg := t.traceConfig(dest)
+// probeID identifies a probe within a trace.
+type probeID struct {
+	// seq is the probe number.
+	seq uint16
+	// flow selects the flow the probe belongs to in Paris mode.
+	flow uint16
+}
+
+// prober sends probes using one of the supported methods and recognizes
+// the packets replying to them. Probes are numbered by the caller and it is
+// up to the prober to encode this number in the packet.
+type prober interface {
+	// send sends probe id with the given TTL and returns the time it was
+	// sent at.
+	send(ttl int, id probeID) (time.Time, error)
+	// match returns true if p is a reply to probe id.
+	match(p packetInfo, id probeID) bool
+}
+
+// packetReader is implemented by probers receiving replies on their own
+// socket in addition to the ICMP packetConn. Replies from both are then
+// read through the prober.
+type packetReader interface {
+	read(deadline time.Time) (packetInfo, error)
+}
+
+// probeDescriber is implemented by probers able to tell the header fields of
+// the probes they send, to detect their modification on the path. It
+// returns false if the quoted headers cannot be trusted.
+type probeDescriber interface {
+	sent(id probeID) (sentProbe, bool)
+}
 
-	conn, err := newPacketConn(cfg.family)
+// openProbe opens the sockets needed to probe dest and returns the function
+// sending probes on them. The returned close function must be called once
+// done.
+func (t *Tracer) openProbe(ctx context.Context, cfg traceConfig, dest net.IP) (probe batchProbeFunc, close func(), err error) {
+	s, err := newSession(cfg, dest)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer conn.Close()
-	return t.traceWithConn(ctx, dest, c, conn)
+	done := closeOnDone(ctx, s.conn)
+	return t.batchProbe(ctx, cfg, s.conn, s.pr), func() {
+		done()
+		_ = s.Close()
+	}, nil
 }
 
-func (t *Tracer) traceWithConn(ctx context.Context, dest net.IP, c chan Hop, conn packetConn) error {
-	cfg := t.traceConfig(dest)
-	family := cfg.family
-	dst := net.IPAddr{IP: dest}
+// TraceMultipath discovers the paths toward dest through per-flow load
+// balancers using the Multipath Detection Algorithm. Probes are sent in
+// Paris mode, each flow following a single path, with as many flows per hop
+// as needed to find all its interfaces with a 95% confidence.
+func (t *Tracer) TraceMultipath(ctx context.Context, dest net.IP) (*Graph, error) {
+	mt := *t
+	mt.Paris = true
+	cfg := mt.traceConfig(dest)
+	s, err := newSession(cfg, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	defer closeOnDone(ctx, s.conn)()
+	var seq uint16
+	return t.traceMultipathWithFunc(ctx, cfg, func(probes []flowProbe, timeout time.Duration, result func(int, probeResult)) error {
+		ttls := make([]int, len(probes))
+		ids := make([]probeID, len(probes))
+		for i, p := range probes {
+			ttls[i] = p.ttl
+			ids[i] = probeID{seq: seq + uint16(i), flow: p.flow}
+		}
+		_, err := t.probe(ctx, s.conn, cfg.family, s.pr, ttls, ids, timeout, result)
+		if err == nil {
+			seq += uint16(len(probes))
+		}
+		return err
+	})
+}
 
-	// Prepare ICMP packet.
-	id := rand.Intn(0xffff)
-	wmb := icmp.Echo{
-		ID:   id,
-		Data: make([]byte, cfg.packetSize),
+// session holds the sockets used to probe a destination.
+type session struct {
+	conn packetConn
+	pr   prober
+}
+
+func newSession(cfg traceConfig, dest net.IP) (*session, error) {
+	var err error
+	if cfg.bind, err = cfg.bind.forFamily(cfg.family); err != nil {
+		return nil, err
+	}
+	conn, err := cfg.mux.open("icmp", cfg, dest)
+	if err != nil && cfg.method == MethodICMP && errors.Is(err, os.ErrPermission) {
+		// Errors triggered by UDP and TCP probes are not delivered to
+		// datagram ICMP sockets, only ICMP probes can use those.
+		if c, derr := newDgramConn(cfg.family, cfg.bind); derr == nil {
+			conn, err = setTrafficClass(c, cfg, dest)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pr prober
+	switch cfg.method {
+	case MethodICMP:
+		// The source address is only used to detect NAT.
+		src, _ := sourceAddr(cfg.family, dest, cfg.bind)
+		pr = newICMPProber(cfg, src, dest, conn)
+	case MethodUDP:
+		pr, err = newUDPProber(cfg, dest)
+	case MethodTCP:
+		pr, err = newTCPProber(cfg, dest, conn)
+	default:
+		err = &Error{Kind: ErrUnsupported, Op: fmt.Sprintf("method %v", cfg.method)}
 	}
-	wm := icmp.Message{
-		Type: icmpEchoType(family),
-		Code: 0,
-		Body: &wmb,
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if o, ok := pr.(packetOwner); ok {
+		setOwner(conn, o)
 	}
+	return &session{conn: conn, pr: pr}, nil
+}
 
-	seq := uint16(rand.Intn(0xffff))
+func (s *session) Close() error {
+	if c, ok := s.pr.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return s.conn.Close()
+}
+
+// setTrafficClass returns conn sending its packets with the TOS or traffic
+// class and the flow label of cfg, if set.
+func setTrafficClass(conn packetConn, cfg traceConfig, dest net.IP) (packetConn, error) {
+	if cfg.class.tos != 0 {
+		s, ok := conn.(tosSetter)
+		if !ok {
+			conn.Close()
+			return nil, &Error{Kind: ErrUnsupported, Op: "TOS"}
+		}
+		if err := s.setTOS(cfg.class.tos); err != nil {
+			conn.Close()
+			return nil, socketError("cannot set TOS", err)
+		}
+	}
+	if cfg.family == 6 && cfg.class.flowLabel != 0 {
+		c, err := setFlowLabel(conn, dest, cfg.class.flowLabel)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = c
+	}
+	return conn, nil
+}
 
+// closeOnDone closes conn when ctx is done, so that pending reads return.
+// The returned function must be called to release the watching goroutine.
+func closeOnDone(ctx context.Context, conn packetConn) func() {
 	done := make(chan struct{})
-	defer close(done)
 	go func() {
 		select {
 		case <-ctx.Done():
@@ -61,78 +206,575 @@ func (t *Tracer) traceWithConn(ctx context.Context, dest net.IP, c chan Hop, con
 		case <-done:
 		}
 	}()
-	return t.traceWithFunc(ctx, cfg, c, func(ttl int, timeout time.Duration) (HopInfo, bool, error) {
-		info, last, err := t.probe(ctx, conn, family, ttl, &dst, &wm, &wmb, seq, timeout)
+	return func() { close(done) }
+}
+
+func (t *Tracer) traceWithConn(ctx context.Context, dest net.IP, c chan Hop, conn packetConn) error {
+	cfg := t.traceConfig(dest)
+	_, err := t.traceWithProber(ctx, cfg, c, nil, conn, newICMPProber(cfg, nil, dest, conn))
+	return err
+}
+
+func (t *Tracer) traceWithProber(ctx context.Context, cfg traceConfig, c chan Hop, samples chan<- Sample, conn packetConn, pr prober) (*Result, error) {
+	defer closeOnDone(ctx, conn)()
+	return t.traceWithFunc(ctx, cfg, c, samples, t.batchProbe(ctx, cfg, conn, pr))
+}
+
+// batchProbe returns a batchProbeFunc sending probes with pr and reading
+// replies from conn. Probes are numbered consecutively across calls.
+func (t *Tracer) batchProbe(ctx context.Context, cfg traceConfig, conn packetConn, pr prober) batchProbeFunc {
+	var seq uint16
+	return func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		ids := make([]probeID, len(ttls))
+		for i := range ids {
+			ids[i] = probeID{seq: seq + uint16(i)}
+		}
+		_, err := t.probe(ctx, conn, cfg.family, pr, ttls, ids, timeout, result)
 		if err == nil {
-			seq++
+			seq += uint16(len(ttls))
 		}
-		return info, last, err
-	})
+		return err
+	}
 }
 
-func (t *Tracer) probe(ctx context.Context, conn packetConn, family int, ttl int, dst net.Addr, wm *icmp.Message, wmb *icmp.Echo, seq uint16, timeout time.Duration) (HopInfo, bool, error) {
-	wmb.Seq = int(seq)
-	wb, err := wm.Marshal(nil)
-	if err != nil {
-		return HopInfo{}, false, fmt.Errorf("cannot marshal ICMP packet: %v", err)
-	}
-	if err := conn.SetHopLimit(ttl); err != nil {
-		return HopInfo{}, false, fmt.Errorf("cannot set hop limit: %v", err)
-	}
-	start := time.Now()
-	if _, err := conn.Write(wb, dst); err != nil {
-		return HopInfo{}, false, fmt.Errorf("cannot write ICMP packet: %v", err)
+// probe sends a probe for each of ttls, identified by the id at the same
+// index, and waits for their replies. Replies are matched to their probe
+// whatever the order they come back in. If result is not nil, it is called
+// for each reply as soon as it is matched and for each timed out probe up to
+// the destination of its flow once done.
+func (t *Tracer) probe(ctx context.Context, conn packetConn, family int, pr prober, ttls []int, ids []probeID, timeout time.Duration, result func(int, probeResult)) ([]probeResult, error) {
+	results := make([]probeResult, len(ttls))
+	sent := make([]time.Time, len(ttls))
+	for i, ttl := range ttls {
+		start, err := pr.send(ttl, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		sent[i] = start
+		results[i].info = HopInfo{RTT: -1, Sent: start}
 	}
-	deadline := start.Add(timeout)
-	for {
+	deadline := sent[len(sent)-1].Add(timeout)
+	answered := make([]bool, len(ttls))
+	// lastTTL holds the lowest TTL the destination replied to for each
+	// flow, replies of the flow to higher TTLs are not needed.
+	lastTTL := map[uint16]int{}
+	for !probesDone(ttls, ids, answered, lastTTL) {
 		if err := ctx.Err(); err != nil {
-			return HopInfo{}, false, err
+			return nil, canceledError(err)
 		}
-		if err := conn.SetReadDeadline(deadline); err != nil {
-			return HopInfo{}, false, fmt.Errorf("cannot set read deadline: %v", err)
+		var p packetInfo
+		var err error
+		if r, ok := pr.(packetReader); ok {
+			p, err = r.read(deadline)
+		} else {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return nil, socketError("cannot set read deadline", err)
+			}
+			p, err = readPacket(conn, family)
 		}
-		p, err := readPacket(conn, family)
 		if err != nil {
 			if isTimeout(err) {
-				return HopInfo{RTT: -1}, false, nil
+				break
 			}
 			if err := ctx.Err(); err != nil {
-				return HopInfo{}, false, err
+				return nil, canceledError(err)
 			}
-			return HopInfo{}, false, err
+			var e *Error
+			if !errors.As(err, &e) {
+				err = socketError("cannot read packet", err)
+			}
+			return nil, err
 		}
-		if !p.Valid || p.ID != wmb.ID || p.Seq != wmb.Seq {
+		if !p.Valid {
 			continue
 		}
-		return HopInfo{
-			IP:  netAddrToIP(p.Peer),
-			RTT: time.Since(start),
-		}, p.Last, nil
+		for i := range ids {
+			if answered[i] || !pr.match(p, ids[i]) {
+				continue
+			}
+			answered[i] = true
+			reply := p.Reply
+			var mods []string
+			if d, ok := pr.(probeDescriber); ok && p.Quote != nil {
+				if s, ok := d.sent(ids[i]); ok {
+					mods = s.modifications(*p.Quote)
+				}
+			}
+			rtt, clock := time.Since(sent[i]), ClockUser
+			if p.Received.After(sent[i]) {
+				rtt, clock = p.Received.Sub(sent[i]), p.Clock
+			}
+			results[i] = probeResult{
+				info: HopInfo{
+					IP:            netAddrToIP(p.Peer),
+					RTT:           rtt,
+					Clock:         clock,
+					MPLS:          p.MPLS,
+					Interfaces:    p.Interfaces,
+					Reply:         &reply,
+					Modifications: mods,
+					Sent:          sent[i],
+				},
+				last: p.Last,
+			}
+			if p.Last && beforeLast(ttls[i], ids[i].flow, lastTTL) {
+				lastTTL[ids[i].flow] = ttls[i]
+			}
+			if result != nil {
+				result(i, results[i])
+			}
+			break
+		}
+	}
+	if result != nil {
+		for i, ttl := range ttls {
+			if !answered[i] && beforeLast(ttl, ids[i].flow, lastTTL) {
+				result(i, results[i])
+			}
+		}
 	}
+	return results, nil
 }
 
-func readPacket(conn packetConn, family int) (packetInfo, error) {
-	buf := make([]byte, 1500)
-	n, peer, err := conn.Read(buf)
+// probesDone returns true once all the probes below the TTL the destination
+// replied to for their flow, or all of them if it did not, are answered.
+func probesDone(ttls []int, ids []probeID, answered []bool, lastTTL map[uint16]int) bool {
+	for i, ttl := range ttls {
+		if !answered[i] && beforeLast(ttl, ids[i].flow, lastTTL) {
+			return false
+		}
+	}
+	return true
+}
+
+// beforeLast returns true if ttl is below the lowest TTL the destination
+// replied to for flow, or if it did not.
+func beforeLast(ttl int, flow uint16, lastTTL map[uint16]int) bool {
+	last, found := lastTTL[flow]
+	return !found || ttl < last
+}
+
+// icmpProber sends ICMP Echo requests on the packetConn also used to
+// receive replies.
+type icmpProber struct {
+	conn   packetConn
+	family int
+	// src is the source address of probes, if known.
+	src net.IP
+	dst net.Addr
+	wm  icmp.Message
+	wmb *icmp.Echo
+	// seq is the sequence number of the first probe.
+	seq   uint16
+	paris bool
+	class trafficClass
+}
+
+// echoIDConn is implemented by packetConns imposing the Echo ID of
+// requests: datagram sockets on which the kernel sets it and sockets shared
+// through a Mux.
+type echoIDConn interface {
+	echoID() int
+}
+
+// errQueueConn is implemented by packetConns rebuilding ICMP errors from the
+// error queue of the socket.
+type errQueueConn interface {
+	readErrQueue(fd int, b []byte) (int, net.Addr, int, time.Time, error)
+}
+
+func newICMPProber(cfg traceConfig, src, dest net.IP, conn packetConn) *icmpProber {
+	wmb := &icmp.Echo{
+		ID:   rand.Intn(0xffff),
+		Data: make([]byte, cfg.packetSize),
+	}
+	if c, ok := conn.(echoIDConn); ok {
+		wmb.ID = c.echoID()
+	}
+	if cfg.paris && len(wmb.Data) < 2 {
+		wmb.Data = make([]byte, 2)
+	}
+	return &icmpProber{
+		conn:   conn,
+		family: cfg.family,
+		src:    src,
+		dst:    &net.IPAddr{IP: dest},
+		wm: icmp.Message{
+			Type: icmpEchoType(cfg.family),
+			Code: 0,
+			Body: wmb,
+		},
+		wmb:   wmb,
+		seq:   uint16(rand.Intn(0xffff)),
+		paris: cfg.paris,
+		class: cfg.class,
+	}
+}
+
+func (p *icmpProber) marshal(id probeID) ([]byte, error) {
+	seq := p.seq + id.seq
+	p.wmb.Seq = int(seq)
+	if p.paris {
+		// Compensate the sequence number in the payload so that the sum of
+		// both, and thus the checksum, only depends on the flow.
+		binary.BigEndian.PutUint16(p.wmb.Data[0:2], checksumFold(uint32(^seq)+uint32(id.flow)))
+	}
+	var psh []byte
+	if p.family == 6 && p.src != nil {
+		// The kernel computes the checksum anyway, this is to know it.
+		psh = icmp.IPv6PseudoHeader(p.src, netAddrToIP(p.dst))
+	}
+	return p.wm.Marshal(psh)
+}
+
+func (p *icmpProber) send(ttl int, id probeID) (time.Time, error) {
+	wb, err := p.marshal(id)
 	if err != nil {
-		return packetInfo{}, err
+		return time.Time{}, &Error{Kind: ErrSocket, Op: "cannot marshal ICMP packet", Err: err}
+	}
+	if err := p.conn.SetHopLimit(ttl); err != nil {
+		return time.Time{}, socketError("cannot set hop limit", err)
 	}
-	id, seq, last, ok, err := handleICMPPacket(buf[:n], family)
+	start, err := writeTimed(p.conn, wb, p.dst)
 	if err != nil {
-		return packetInfo{}, fmt.Errorf("cannot parse ICMP packet: %v", err)
+		return time.Time{}, socketError("cannot write ICMP packet", err)
 	}
-	if !ok {
+	return start, nil
+}
+
+func (p *icmpProber) match(pkt packetInfo, id probeID) bool {
+	return pkt.Proto == icmpProto(p.family) && pkt.ID == p.wmb.ID && pkt.Seq == int(p.seq+id.seq)
+}
+
+func (p *icmpProber) owns(pkt packetInfo) bool {
+	return pkt.Proto == icmpProto(p.family) && pkt.ID == p.wmb.ID
+}
+
+func (p *icmpProber) sent(id probeID) (sentProbe, bool) {
+	if _, ok := p.conn.(errQueueConn); ok {
+		// Errors are rebuilt from the error queue of datagram sockets.
+		return sentProbe{}, false
+	}
+	wb, err := p.marshal(id)
+	if err != nil {
+		return sentProbe{}, false
+	}
+	s := newSentProbe(p.family, p.src, len(wb), p.class)
+	if p.family == 4 || p.src != nil {
+		s.checksum, s.hasChecksum = binary.BigEndian.Uint16(wb[2:4]), true
+	}
+	return s, true
+}
+
+// udpProber sends UDP datagrams from a dedicated socket. ICMP errors they
+// trigger are read from the ICMP packetConn.
+type udpProber struct {
+	conn    packetConn
+	family  int
+	src     net.IP
+	dst     net.IP
+	srcPort int
+	// port is the fixed destination port, or zero to use incrementing
+	// ports. In Paris mode, each flow uses the next port.
+	port    int
+	payload []byte
+	class   trafficClass
+}
+
+func newUDPProber(cfg traceConfig, dest net.IP) (*udpProber, error) {
+	src, err := sourceAddr(cfg.family, dest, cfg.bind)
+	if err != nil && cfg.port != 0 {
+		// Probes to a fixed port are identified by their checksum, which
+		// depends on the source address. Otherwise, it is only used to
+		// detect NAT.
+		return nil, socketError("cannot find source address", err)
+	}
+	conn, srcPort, err := newUDPConn(cfg.family, cfg.bind)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = setTrafficClass(conn, cfg, dest); err != nil {
+		return nil, err
+	}
+	return newUDPProberWithConn(cfg, src, dest, conn, srcPort), nil
+}
+
+func newUDPProberWithConn(cfg traceConfig, src, dest net.IP, conn packetConn, srcPort int) *udpProber {
+	p := &udpProber{
+		conn:    conn,
+		family:  cfg.family,
+		srcPort: srcPort,
+		port:    cfg.port,
+		payload: make([]byte, cfg.packetSize),
+		class:   cfg.class,
+	}
+	if cfg.family == 4 {
+		p.src, p.dst = src.To4(), dest.To4()
+	} else {
+		p.src, p.dst = src.To16(), dest.To16()
+	}
+	if p.port != 0 && len(p.payload) < 2 {
+		p.payload = make([]byte, 2)
+	}
+	return p
+}
+
+func (p *udpProber) Close() error {
+	return p.conn.Close()
+}
+
+func (p *udpProber) dstPort(id probeID) int {
+	if p.port != 0 {
+		return p.port + int(id.flow)
+	}
+	return DefaultUDPPort + int(id.seq)%probePortRange
+}
+
+func (p *udpProber) send(ttl int, id probeID) (time.Time, error) {
+	port := p.dstPort(id)
+	if p.port != 0 {
+		setUDPChecksum(p.payload, p.src, p.dst, p.srcPort, port, udpProbeChecksum(id.seq))
+	}
+	if err := p.conn.SetHopLimit(ttl); err != nil {
+		return time.Time{}, socketError("cannot set hop limit", err)
+	}
+	start, err := writeTimed(p.conn, p.payload, &net.UDPAddr{IP: p.dst, Port: port})
+	if err != nil {
+		return time.Time{}, socketError("cannot write UDP packet", err)
+	}
+	return start, nil
+}
+
+func (p *udpProber) sent(id probeID) (sentProbe, bool) {
+	s := newSentProbe(p.family, p.src, udpHeaderLen+len(p.payload), p.class)
+	switch {
+	case p.port != 0:
+		s.checksum, s.hasChecksum = udpProbeChecksum(id.seq), true
+	case p.src != nil:
+		s.checksum, s.hasChecksum = ^checksumFold(udpSum(p.src, p.dst, p.srcPort, p.dstPort(id), p.payload)), true
+		if s.checksum == 0 {
+			s.checksum = 0xffff
+		}
+	}
+	if s.hasChecksum && p.src != nil {
+		length := udpHeaderLen + len(p.payload)
+		s.partialChecksum = checksumFold(pseudoHeaderSum(p.src, p.dst, protocolUDP, length))
+	}
+	return s, true
+}
+
+func (p *udpProber) owns(pkt packetInfo) bool {
+	return pkt.Proto == protocolUDP && pkt.ID == p.srcPort
+}
+
+func (p *udpProber) match(pkt packetInfo, id probeID) bool {
+	if pkt.Proto != protocolUDP || pkt.ID != p.srcPort || pkt.Seq != p.dstPort(id) {
+		return false
+	}
+	return p.port == 0 || pkt.Checksum == udpProbeChecksum(id.seq)
+}
+
+// tcpProber sends TCP SYN segments on a raw TCP socket. SYN-ACK or RST
+// segments from the destination are read on that socket while ICMP errors
+// are read on the ICMP packetConn.
+type tcpProber struct {
+	conn   packetConn
+	family int
+	src    net.IP
+	dst    net.IP
+	// srcPort is the source port of the first probe, following probes use
+	// incrementing ports. In Paris mode, ports are incremented per flow
+	// instead.
+	srcPort int
+	paris   bool
+	port    int
+	seq     uint32
+	class   trafficClass
+	packets chan readResult
+	done    chan struct{}
+}
+
+type readResult struct {
+	p   packetInfo
+	err error
+}
+
+func newTCPProber(cfg traceConfig, dest net.IP, icmpConn packetConn) (*tcpProber, error) {
+	src, err := sourceAddr(cfg.family, dest, cfg.bind)
+	if err != nil {
+		return nil, socketError("cannot find source address", err)
+	}
+	conn, err := cfg.mux.open("tcp", cfg, dest)
+	if err != nil {
+		return nil, err
+	}
+	p := newTCPProberWithConn(cfg, src, dest, icmpConn, conn)
+	setOwner(conn, p)
+	return p, nil
+}
+
+func newTCPProberWithConn(cfg traceConfig, src, dest net.IP, icmpConn, conn packetConn) *tcpProber {
+	p := &tcpProber{
+		conn:    conn,
+		family:  cfg.family,
+		srcPort: 32768 + rand.Intn(0x7fff-probePortRange),
+		port:    cfg.port,
+		seq:     rand.Uint32(),
+		paris:   cfg.paris,
+		class:   cfg.class,
+		packets: make(chan readResult),
+		done:    make(chan struct{}),
+	}
+	if cfg.family == 4 {
+		p.src, p.dst = src.To4(), dest.To4()
+	} else {
+		p.src, p.dst = src.To16(), dest.To16()
+	}
+	go p.readLoop(func() (packetInfo, error) {
+		return readPacket(icmpConn, cfg.family)
+	})
+	go p.readLoop(func() (packetInfo, error) {
+		return readTCPPacket(conn)
+	})
+	return p
+}
+
+// Close closes the TCP socket. The ICMP packetConn must be closed by the
+// caller for all the reading goroutines to return.
+func (p *tcpProber) Close() error {
+	close(p.done)
+	return p.conn.Close()
+}
+
+func (p *tcpProber) readLoop(read func() (packetInfo, error)) {
+	for {
+		pkt, err := read()
+		select {
+		case p.packets <- readResult{pkt, err}:
+		case <-p.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *tcpProber) read(deadline time.Time) (packetInfo, error) {
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case r := <-p.packets:
+		return r.p, r.err
+	case <-t.C:
+		return packetInfo{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *tcpProber) probeSrcPort(id probeID) int {
+	if p.paris {
+		return p.srcPort + int(id.flow)%probePortRange
+	}
+	return p.srcPort + int(id.seq)%probePortRange
+}
+
+func (p *tcpProber) send(ttl int, id probeID) (time.Time, error) {
+	b := marshalTCPSYN(p.src, p.dst, p.probeSrcPort(id), p.port, p.seq+uint32(id.seq))
+	if err := p.conn.SetHopLimit(ttl); err != nil {
+		return time.Time{}, socketError("cannot set hop limit", err)
+	}
+	start, err := writeTimed(p.conn, b, &net.IPAddr{IP: p.dst})
+	if err != nil {
+		return time.Time{}, socketError("cannot write TCP packet", err)
+	}
+	return start, nil
+}
+
+func (p *tcpProber) sent(id probeID) (sentProbe, bool) {
+	b := marshalTCPSYN(p.src, p.dst, p.probeSrcPort(id), p.port, p.seq+uint32(id.seq))
+	s := newSentProbe(p.family, p.src, len(b), p.class)
+	s.checksum, s.hasChecksum = binary.BigEndian.Uint16(b[16:18]), true
+	return s, true
+}
+
+func (p *tcpProber) owns(pkt packetInfo) bool {
+	return pkt.Proto == protocolTCP && pkt.ID >= p.srcPort && pkt.ID < p.srcPort+probePortRange
+}
+
+func (p *tcpProber) match(pkt packetInfo, id probeID) bool {
+	return pkt.Proto == protocolTCP && pkt.ID == p.probeSrcPort(id) && pkt.Seq == p.port && pkt.TCPSeq == p.seq+uint32(id.seq)
+}
+
+// readTCPPacket reads a segment on the raw TCP socket. SYN-ACK and RST
+// segments are returned with the ports and sequence number of the probe
+// they acknowledge.
+func readTCPPacket(conn packetConn) (packetInfo, error) {
+	if c, ok := conn.(*muxConn); ok {
+		return c.readPacket()
+	}
+	buf := make([]byte, 1500)
+	n, peer, ttl, at, clock, err := read(conn, buf)
+	if err != nil {
+		return packetInfo{}, err
+	}
+	h, ok := parseTCPHeader(buf[:n])
+	if !ok || h.Flags&tcpFlagACK == 0 || h.Flags&(tcpFlagSYN|tcpFlagRST) == 0 {
 		return packetInfo{Peer: peer}, nil
 	}
 	return packetInfo{
-		ID:    id,
-		Seq:   seq,
-		Peer:  peer,
-		Last:  last,
-		Valid: true,
+		Proto:    protocolTCP,
+		ID:       h.DstPort,
+		Seq:      h.SrcPort,
+		TCPSeq:   h.Ack - 1,
+		Peer:     peer,
+		Last:     true,
+		Valid:    true,
+		Received: at,
+		Clock:    clock,
+		Reply:    Reply{Proto: "tcp", TTL: ttl},
 	}, nil
 }
 
+func readPacket(conn packetConn, family int) (packetInfo, error) {
+	if c, ok := conn.(*muxConn); ok {
+		return c.readPacket()
+	}
+	buf := make([]byte, 1500)
+	n, peer, ttl, at, clock, err := read(conn, buf)
+	if err != nil {
+		return packetInfo{}, err
+	}
+	p, err := handleICMPPacket(buf[:n], family)
+	if err != nil {
+		return packetInfo{}, &Error{Kind: ErrParse, Op: "cannot parse ICMP packet", Err: err}
+	}
+	p.Peer = peer
+	p.Reply.TTL = ttl
+	p.Received, p.Clock = at, clock
+	return p, nil
+}
+
+// read reads a packet on conn along with its TTL, if conn reports it, and the
+// time it was received at, told by clock. It is the time the kernel received
+// it at if conn reports it, or else the time it is read at.
+func read(conn packetConn, b []byte) (n int, src net.Addr, ttl int, at time.Time, clock string, err error) {
+	switch r := conn.(type) {
+	case stampedReader:
+		n, src, ttl, at, err = r.readStamped(b)
+	case ttlReader:
+		n, src, ttl, err = r.readTTL(b)
+	default:
+		n, src, err = conn.Read(b)
+	}
+	if err != nil {
+		return 0, nil, 0, time.Time{}, "", err
+	}
+	if at.IsZero() {
+		return n, src, ttl, time.Now(), ClockUser, nil
+	}
+	return n, src, ttl, at, ClockKernel, nil
+}
+
 func netAddrToIP(a net.Addr) net.IP {
 	switch v := a.(type) {
 	case *net.UDPAddr:
@@ -152,51 +794,117 @@ func isTimeout(err error) bool {
 	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func handleICMPPacket(rb []byte, family int) (id, seq int, last bool, ok bool, err error) {
+func handleICMPPacket(rb []byte, family int) (packetInfo, error) {
 	proto := icmpProto(family)
 	rm, err := icmp.ParseMessage(proto, rb)
 	if err != nil {
-		return 0, 0, false, false, err
+		return packetInfo{}, err
 	}
-	if !isICMPEchoReply(rm.Type) && !isICMPTimeExceeded(rm.Type) && !isICMPDestinationUnreachable(rm.Type) {
+	if !isICMPEchoReply(rm.Type) && !isICMPTimeExceeded(rm.Type) && !isICMPDestinationUnreachable(rm.Type) && !isICMPTooBig(rm.Type, rm.Code) {
 		// not interested
-		return 0, 0, false, false, nil
+		return packetInfo{}, nil
 	}
+	reply := Reply{Proto: icmpProtoName(family), Type: int(rb[0]), Code: rm.Code}
 	switch pkt := rm.Body.(type) {
 	case *icmp.TimeExceeded:
-		id, seq, ok, err = unwrapICMPPayload(pkt.Data, family)
-		return
+		p, err := unwrapICMPPayload(pkt.Data, family)
+		p.MPLS, p.Interfaces = parseExtensions(pkt.Extensions)
+		reply.setQuoted(p.Reply)
+		p.Reply = reply
+		return p, err
 	case *icmp.DstUnreach:
-		id, seq, ok, err = unwrapICMPPayload(pkt.Data, family)
-		last = true
-		return
+		p, err := unwrapICMPPayload(pkt.Data, family)
+		p.MPLS, p.Interfaces = parseExtensions(pkt.Extensions)
+		reply.setQuoted(p.Reply)
+		if isICMPTooBig(rm.Type, rm.Code) {
+			// The next-hop MTU is in the second half of the unused word.
+			reply.MTU = int(binary.BigEndian.Uint16(rb[6:8]))
+		}
+		p.Reply = reply
+		p.Last = true
+		return p, err
+	case *icmp.PacketTooBig:
+		p, err := unwrapICMPPayload(pkt.Data, family)
+		reply.setQuoted(p.Reply)
+		reply.MTU = pkt.MTU
+		p.Reply = reply
+		return p, err
 	case *icmp.Echo:
-		return pkt.ID, pkt.Seq, true, true, nil
+		return packetInfo{
+			Proto: proto,
+			ID:    pkt.ID,
+			Seq:   pkt.Seq,
+			Last:  true,
+			Valid: true,
+			Reply: reply,
+		}, nil
 	}
-	return 0, 0, false, false, nil
+	return packetInfo{}, nil
 }
 
-func unwrapICMPPayload(rb []byte, family int) (id, seq int, ok bool, err error) {
-	proto := icmpProto(family)
-
-	// Unwrap embedded ICMP packet
-	o, err := ipPayloadOffset(family, rb)
+// unwrapICMPPayload extracts the identifiers, the TTL and the header of the
+// probe quoted in an ICMP error message.
+func unwrapICMPPayload(rb []byte, family int) (p packetInfo, err error) {
+	o, proto, ttl, err := ipPayloadOffset(family, rb)
 	if err != nil {
-		return 0, 0, false, err
+		return packetInfo{}, err
 	}
+	defer func() {
+		p.Reply.QuotedTTL = ttl
+		if p.Valid {
+			if p.Quote = parseQuotedHeader(family, rb, o, proto); p.Quote != nil {
+				tos := p.Quote.tos
+				p.Reply.QuotedTOS, p.Reply.QuotedFlowLabel = &tos, p.Quote.flowLabel
+			}
+		}
+	}()
 	if o < 0 || o >= len(rb) {
 		// can't find payload, should not happen though
-		return 0, 0, false, errors.New("cannot find ICMP payload")
+		return packetInfo{}, errors.New("cannot find ICMP payload")
 	}
 
-	rm, err := icmp.ParseMessage(proto, rb[o:])
-	if err != nil {
-		return 0, 0, false, err
-	}
-	rmb, ok := rm.Body.(*icmp.Echo)
-	if !ok {
-		// may be UDP or other, does not belong to us.
-		return 0, 0, false, nil
+	switch proto {
+	case icmpProto(family):
+		// Unwrap embedded ICMP packet
+		rm, err := icmp.ParseMessage(proto, rb[o:])
+		if err != nil {
+			return packetInfo{}, err
+		}
+		rmb, ok := rm.Body.(*icmp.Echo)
+		if !ok {
+			return packetInfo{}, nil
+		}
+		return packetInfo{
+			Proto: proto,
+			ID:    rmb.ID,
+			Seq:   rmb.Seq,
+			Valid: true,
+		}, nil
+	case protocolUDP:
+		h, ok := parseUDPHeader(rb[o:])
+		if !ok {
+			return packetInfo{}, errors.New("truncated UDP header")
+		}
+		return packetInfo{
+			Proto:    proto,
+			ID:       h.SrcPort,
+			Seq:      h.DstPort,
+			Checksum: h.Checksum,
+			Valid:    true,
+		}, nil
+	case protocolTCP:
+		h, ok := parseTCPHeader(rb[o:])
+		if !ok {
+			return packetInfo{}, errors.New("truncated TCP header")
+		}
+		return packetInfo{
+			Proto:  proto,
+			ID:     h.SrcPort,
+			Seq:    h.DstPort,
+			TCPSeq: h.Seq,
+			Valid:  true,
+		}, nil
 	}
-	return rmb.ID, rmb.Seq, true, nil
+	// other protocol, does not belong to us.
+	return packetInfo{}, nil
 }
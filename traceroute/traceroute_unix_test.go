@@ -5,9 +5,13 @@ package traceroute
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -41,6 +45,7 @@ func TestTraceWithConnProbesInRounds(t *testing.T) {
 		MaxHops:    5,
 		HopTimeout: time.Second,
 		Probes:     3,
+		Window:     1,
 	}, dest, conn)
 	if err != nil {
 		t.Fatalf("Trace() error = %v", err)
@@ -67,6 +72,167 @@ func TestTraceWithConnProbesInRounds(t *testing.T) {
 	}
 }
 
+func TestTraceWithConnProbesAllTTLsAtOnce(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 13)
+	script := func(call writeCall) []readAction {
+		if call.ttl == 1 {
+			return []readAction{{
+				packet: ipv4TimeExceededPacket(call.id, call.seq),
+				addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+			}}
+		}
+		return []readAction{{
+			packet: ipv4EchoReplyPacket(call.id, call.seq),
+			addr:   &net.IPAddr{IP: dest},
+		}}
+	}
+	tests := []struct {
+		name      string
+		window    int
+		hopLimits []int
+	}{
+		{"all", 0, []int{1, 2, 3, 4, 5, 1, 2, 1, 2}},
+		{"window", 2, []int{1, 2, 1, 2, 1, 2}},
+		{"window reaching past destination", 3, []int{1, 2, 3, 1, 2, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakePacketConn{family: 4, script: script}
+			hops, err := collectTrace(Tracer{
+				MaxHops:    5,
+				HopTimeout: time.Second,
+				Probes:     3,
+				Window:     tt.window,
+			}, dest, conn)
+			if err != nil {
+				t.Fatalf("Trace() error = %v", err)
+			}
+			if got, want := conn.hopLimits, tt.hopLimits; !reflect.DeepEqual(got, want) {
+				t.Fatalf("hop limits = %v, want %v", got, want)
+			}
+			if got, want := len(hops), 2; got != want {
+				t.Fatalf("len(hops) = %d, want %d", got, want)
+			}
+			for i, hop := range hops {
+				if got, want := len(hop.Info), 3; got != want {
+					t.Fatalf("hop %d samples = %d, want %d", i, got, want)
+				}
+			}
+			if got, want := hops[1].IPs(), []net.IP{dest}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("hop 2 IPs = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTraceWithConnOutOfOrderReplies(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 14)
+	conn := &fakePacketConn{
+		family: 4,
+		script: func(call writeCall) []readAction {
+			if call.ttl < 3 {
+				return nil
+			}
+			// All replies come back once the last probe is sent, in
+			// reverse order.
+			return []readAction{
+				{
+					packet: ipv4EchoReplyPacket(call.id, call.seq),
+					addr:   &net.IPAddr{IP: dest},
+				},
+				{
+					packet: ipv4TimeExceededPacket(call.id, call.seq-1),
+					addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 2)},
+				},
+				{
+					packet: ipv4TimeExceededPacket(call.id, call.seq-2),
+					addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+				},
+			}
+		},
+	}
+	hops, err := collectTrace(Tracer{
+		MaxHops:    3,
+		HopTimeout: time.Second,
+		Probes:     1,
+	}, dest, conn)
+	if err != nil {
+		t.Fatalf("Trace() error = %v", err)
+	}
+	want := [][]net.IP{
+		{net.IPv4(192, 0, 2, 1)},
+		{net.IPv4(192, 0, 2, 2)},
+		{dest},
+	}
+	if got, want := len(hops), len(want); got != want {
+		t.Fatalf("len(hops) = %d, want %d", got, want)
+	}
+	for i, hop := range hops {
+		if got := hop.IPs(); !reflect.DeepEqual(got, want[i]) {
+			t.Fatalf("hop %d IPs = %v, want %v", i+1, got, want[i])
+		}
+	}
+}
+
+func TestTraceSamplesInArrivalOrder(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 15)
+	conn := &fakePacketConn{
+		family: 4,
+		script: func(call writeCall) []readAction {
+			if call.ttl < 3 {
+				return nil
+			}
+			return []readAction{
+				{
+					packet: ipv4EchoReplyPacket(call.id, call.seq),
+					addr:   &net.IPAddr{IP: dest},
+				},
+				{
+					packet: ipv4TimeExceededPacket(call.id, call.seq-2),
+					addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+				},
+				{err: timeoutError{}},
+			}
+		},
+	}
+	tr := Tracer{
+		MaxHops:    3,
+		HopTimeout: time.Second,
+		Probes:     1,
+	}
+	cfg := tr.traceConfig(dest)
+	samples := make(chan Sample, 3)
+	res, err := tr.traceWithProber(context.Background(), cfg, nil, samples, conn, newICMPProber(cfg, nil, dest, conn))
+	close(samples)
+	if err != nil {
+		t.Fatalf("TraceSamples() error = %v", err)
+	}
+	hops := res.Hops
+	var got []Sample
+	for s := range samples {
+		got = append(got, s)
+	}
+	want := []Sample{
+		{TTL: 3, Last: true, HopInfo: HopInfo{IP: dest}},
+		{TTL: 1, HopInfo: HopInfo{IP: net.IPv4(192, 0, 2, 1)}},
+		{TTL: 2, HopInfo: HopInfo{RTT: -1}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("samples = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i].TTL != want[i].TTL || got[i].Last != want[i].Last || !got[i].IP.Equal(want[i].IP) || (want[i].RTT == -1) != (got[i].RTT == -1) {
+			t.Fatalf("sample %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got, want := len(hops), 3; got != want {
+		t.Fatalf("len(hops) = %d, want %d", got, want)
+	}
+	if got, want := hops[1].RTTs(), []time.Duration{-1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 2 RTTs = %v, want %v", got, want)
+	}
+}
+
 func TestTraceWithConnTimeoutDoesNotResetOnUnmatchedPacket(t *testing.T) {
 	conn := &fakePacketConn{
 		family: 4,
@@ -120,11 +286,21 @@ func TestTraceWithConnPropagatesParseErrors(t *testing.T) {
 	if err == nil {
 		t.Fatal("Trace() error = nil, want parse error")
 	}
-	if !strings.Contains(err.Error(), "cannot parse ICMP packet") {
+	if !strings.Contains(err.Error(), "cannot parse ICMP packet") || !errors.Is(err, ErrParse) {
 		t.Fatalf("Trace() error = %v, want parse error", err)
 	}
 }
 
+func TestTraceWithConnCanceled(t *testing.T) {
+	conn := &fakePacketConn{family: 4}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := (&Tracer{}).traceWithConn(ctx, net.IPv4(203, 0, 113, 13), make(chan Hop, DefaultMaxHops), conn)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Trace() error = %v, want ErrCanceled wrapping context.Canceled", err)
+	}
+}
+
 func collectTrace(t Tracer, dest net.IP, conn packetConn) ([]Hop, error) {
 	size := t.MaxHops
 	if size == 0 {
@@ -144,6 +320,7 @@ type fakePacketConn struct {
 	family      int
 	currentTTL  int
 	hopLimits   []int
+	checksums   []int
 	deadlines   []time.Time
 	readActions []readAction
 	script      func(writeCall) []readAction
@@ -174,6 +351,7 @@ func (c *fakePacketConn) Write(b []byte, dst net.Addr) (int, error) {
 	if !ok {
 		return 0, nil
 	}
+	c.checksums = append(c.checksums, msg.Checksum)
 	if c.script != nil {
 		c.readActions = append(c.readActions, c.script(writeCall{
 			ttl: c.currentTTL,
@@ -271,3 +449,616 @@ func ipv4TimeExceededPacket(id, seq int) []byte {
 	}
 	return packet
 }
+
+func TestHandleICMPPacketReply(t *testing.T) {
+	dscp := ipv4TimeExceededPacket(1, 2)
+	dscp[8+1] = 0xb8 // TOS of the quoted header
+	tos := func(tos int) *int { return &tos }
+	tests := []struct {
+		packet []byte
+		want   Reply
+	}{
+		{ipv4TimeExceededPacket(1, 2), Reply{Proto: "icmp", Type: 11, Code: 0, QuotedTTL: 1, QuotedTOS: tos(0)}},
+		{dscp, Reply{Proto: "icmp", Type: 11, Code: 0, QuotedTTL: 1, QuotedTOS: tos(0xb8)}},
+		{ipv4EchoReplyPacket(1, 2), Reply{Proto: "icmp", Type: 0, Code: 0}},
+		{ipv4UDPErrorPacket(ipv4.ICMPTypeDestinationUnreachable, 13, 1234, 53, 0), Reply{Proto: "icmp", Type: 3, Code: 13, QuotedTTL: 1, QuotedTOS: tos(0)}},
+	}
+	for _, tt := range tests {
+		p, err := handleICMPPacket(tt.packet, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Reply, tt.want) {
+			t.Errorf("handleICMPPacket() reply = %+v, want %+v", p.Reply, tt.want)
+		}
+	}
+}
+
+func TestHandleICMPPacketExtensions(t *testing.T) {
+	packet := ipv4TimeExceededPacket(1, 2)
+	msg, err := icmp.ParseMessage(protocolICMP, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Body.(*icmp.TimeExceeded).Extensions = []icmp.Extension{
+		&icmp.MPLSLabelStack{
+			Class:  1,
+			Type:   1,
+			Labels: []icmp.MPLSLabel{{Label: 24001, TC: 0, S: true, TTL: 1}},
+		},
+		&icmp.InterfaceInfo{
+			Class:     2,
+			Type:      0x0f,
+			Interface: &net.Interface{Index: 5, Name: "ge-0/0/1", MTU: 9000},
+			Addr:      &net.IPAddr{IP: net.IPv4(192, 0, 2, 1).To4()},
+		},
+	}
+	packet, err = msg.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := handleICMPPacket(packet, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Valid || p.ID != 1 || p.Seq != 2 {
+		t.Fatalf("handleICMPPacket() = %+v, want probe 1/2", p)
+	}
+	if want := []MPLSLabel{{Label: 24001, S: true, TTL: 1}}; !reflect.DeepEqual(p.MPLS, want) {
+		t.Errorf("MPLS = %+v, want %+v", p.MPLS, want)
+	}
+	want := []InterfaceInfo{{Role: "incoming", Index: 5, Name: "ge-0/0/1", IP: net.IPv4(192, 0, 2, 1).To4(), MTU: 9000}}
+	if !reflect.DeepEqual(p.Interfaces, want) {
+		t.Errorf("Interfaces = %+v, want %+v", p.Interfaces, want)
+	}
+
+	h := Hop{Seq: 3, Info: []HopInfo{
+		{IP: net.IPv4(198, 51, 100, 1), RTT: 12 * time.Millisecond, MPLS: p.MPLS, Interfaces: p.Interfaces},
+		{IP: net.IPv4(198, 51, 100, 1), RTT: 13 * time.Millisecond, MPLS: p.MPLS},
+	}}
+	wantString := "  3   198.51.100.1   12ms  13ms" +
+		"\n      MPLS L=24001,TC=0,S=1,TTL=1" +
+		"\n      interface incoming ge-0/0/1 index=5 192.0.2.1 mtu=9000"
+	if got := h.String(); got != wantString {
+		t.Errorf("String() = %q, want %q", got, wantString)
+	}
+}
+
+func TestTraceUDPIncrementingPorts(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 20)
+	conn := &fakePacketConn{family: 4}
+	udp := &fakeUDPConn{
+		icmp: conn,
+		script: func(call udpWriteCall) []readAction {
+			switch call.ttl {
+			case 1:
+				return []readAction{{
+					packet: ipv4UDPErrorPacket(ipv4.ICMPTypeTimeExceeded, 0, 40000, call.port, call.checksum),
+					addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+				}}
+			default:
+				return []readAction{{
+					packet: ipv4UDPErrorPacket(ipv4.ICMPTypeDestinationUnreachable, 3, 40000, call.port, call.checksum),
+					addr:   &net.IPAddr{IP: dest},
+				}}
+			}
+		},
+	}
+	tr := Tracer{
+		MaxHops:    5,
+		HopTimeout: time.Second,
+		Probes:     2,
+		Method:     MethodUDP,
+	}
+	cfg := tr.traceConfig(dest)
+	pr := newUDPProberWithConn(cfg, nil, dest, udp, 40000)
+	hops, err := collectTraceWithProber(tr, dest, conn, pr)
+	if err != nil {
+		t.Fatalf("Trace() error = %v", err)
+	}
+	// All TTLs are probed in the first round, then only up to the
+	// destination.
+	if got, want := udp.ports, []int{33434, 33435, 33436, 33437, 33438, 33439, 33440}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ports = %v, want %v", got, want)
+	}
+	if got, want := len(hops), 2; got != want {
+		t.Fatalf("len(hops) = %d, want %d", got, want)
+	}
+	if got, want := hops[0].IPs(), []net.IP{net.IPv4(192, 0, 2, 1)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 1 IPs = %v, want %v", got, want)
+	}
+	if got, want := hops[1].IPs(), []net.IP{dest}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 2 IPs = %v, want %v", got, want)
+	}
+}
+
+func TestTraceUDPFixedPortMatchesChecksum(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 21)
+	conn := &fakePacketConn{family: 4}
+	udp := &fakeUDPConn{
+		icmp: conn,
+		src:  net.IPv4(198, 51, 100, 1),
+		script: func(call udpWriteCall) []readAction {
+			return []readAction{
+				{
+					// Reply to another probe to the same port.
+					packet: ipv4UDPErrorPacket(ipv4.ICMPTypeTimeExceeded, 0, 40000, call.port, call.checksum+0x1000),
+					addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 99)},
+				},
+				{
+					packet: ipv4UDPErrorPacket(ipv4.ICMPTypeDestinationUnreachable, 3, 40000, call.port, call.checksum),
+					addr:   &net.IPAddr{IP: dest},
+				},
+			}
+		},
+	}
+	tr := Tracer{
+		MaxHops:    5,
+		HopTimeout: time.Second,
+		Probes:     3,
+		Method:     MethodUDP,
+		Port:       53,
+	}
+	cfg := tr.traceConfig(dest)
+	pr := newUDPProberWithConn(cfg, udp.src, dest, udp, 40000)
+	hops, err := collectTraceWithProber(tr, dest, conn, pr)
+	if err != nil {
+		t.Fatalf("Trace() error = %v", err)
+	}
+	if got, want := udp.ports, []int{53, 53, 53, 53, 53, 53, 53}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ports = %v, want %v", got, want)
+	}
+	if got, want := udp.checksums, []uint16{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("checksums = %v, want %v", got, want)
+	}
+	if got, want := len(hops), 1; got != want {
+		t.Fatalf("len(hops) = %d, want %d", got, want)
+	}
+	if got, want := hops[0].IPs(), []net.IP{dest}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 1 IPs = %v, want %v", got, want)
+	}
+}
+
+func TestParisProbesKeepFlowConstant(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 40)
+	src := net.IPv4(198, 51, 100, 1)
+
+	tr := Tracer{Paris: true}
+	icmpConn := &fakePacketConn{family: 4}
+	icmpProber := newICMPProber(tr.traceConfig(dest), nil, dest, icmpConn)
+	for seq := uint16(0); seq < 4; seq++ {
+		if _, err := icmpProber.send(int(seq)+1, probeID{seq: seq}); err != nil {
+			t.Fatalf("ICMP send() error = %v", err)
+		}
+	}
+	for _, sum := range icmpConn.checksums {
+		if sum != icmpConn.checksums[0] {
+			t.Fatalf("ICMP checksums = %v, want constant", icmpConn.checksums)
+		}
+	}
+
+	tr.Method = MethodUDP
+	udp := &fakeUDPConn{icmp: &fakePacketConn{family: 4}, src: src}
+	udpProber := newUDPProberWithConn(tr.traceConfig(dest), src, dest, udp, 40000)
+	for seq := uint16(0); seq < 4; seq++ {
+		if _, err := udpProber.send(int(seq)+1, probeID{seq: seq}); err != nil {
+			t.Fatalf("UDP send() error = %v", err)
+		}
+	}
+	if got, want := udp.ports, []int{DefaultUDPPort, DefaultUDPPort, DefaultUDPPort, DefaultUDPPort}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("UDP ports = %v, want %v", got, want)
+	}
+
+	tcpConn := newChanPacketConn()
+	tcpICMPConn := newChanPacketConn()
+	tr.Method = MethodTCP
+	tcpProber := newTCPProberWithConn(tr.traceConfig(dest), src, dest, tcpICMPConn, tcpConn)
+	defer tcpICMPConn.Close()
+	defer tcpProber.Close()
+	var ports []int
+	var seqs []uint32
+	tcpConn.script = func(ttl int, b []byte) {
+		h, _ := parseTCPHeader(b)
+		ports = append(ports, h.SrcPort)
+		seqs = append(seqs, h.Seq)
+	}
+	for seq := uint16(0); seq < 4; seq++ {
+		if _, err := tcpProber.send(int(seq)+1, probeID{seq: seq}); err != nil {
+			t.Fatalf("TCP send() error = %v", err)
+		}
+	}
+	for i := range ports {
+		if ports[i] != ports[0] || seqs[i] != seqs[0]+uint32(i) {
+			t.Fatalf("TCP ports = %v seqs = %v, want constant ports and incrementing seqs", ports, seqs)
+		}
+	}
+}
+
+func collectTraceWithProber(t Tracer, dest net.IP, conn packetConn, pr prober) ([]Hop, error) {
+	cfg := t.traceConfig(dest)
+	c := make(chan Hop, cfg.maxHops)
+	_, err := t.traceWithProber(context.Background(), cfg, c, nil, conn, pr)
+	close(c)
+	var hops []Hop
+	for hop := range c {
+		hops = append(hops, hop)
+	}
+	return hops, err
+}
+
+// fakeUDPConn records UDP probes and queues the scripted ICMP replies on
+// the ICMP fakePacketConn.
+type fakeUDPConn struct {
+	icmp       *fakePacketConn
+	src        net.IP
+	currentTTL int
+	ports      []int
+	checksums  []uint16
+	script     func(udpWriteCall) []readAction
+}
+
+type udpWriteCall struct {
+	ttl      int
+	port     int
+	checksum uint16
+}
+
+func (c *fakeUDPConn) Close() error {
+	return nil
+}
+
+func (c *fakeUDPConn) Write(b []byte, dst net.Addr) (int, error) {
+	addr := dst.(*net.UDPAddr)
+	checksum := udpChecksum(c.src.To4(), addr.IP.To4(), 40000, addr.Port, b)
+	c.ports = append(c.ports, addr.Port)
+	c.checksums = append(c.checksums, checksum)
+	if c.script != nil {
+		c.icmp.readActions = append(c.icmp.readActions, c.script(udpWriteCall{
+			ttl:      c.currentTTL,
+			port:     addr.Port,
+			checksum: checksum,
+		})...)
+	}
+	return len(b), nil
+}
+
+func (c *fakeUDPConn) Read(b []byte) (int, net.Addr, error) {
+	return 0, nil, timeoutError{}
+}
+
+func (c *fakeUDPConn) SetReadDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (c *fakeUDPConn) SetHopLimit(hoplim int) error {
+	c.currentTTL = hoplim
+	return nil
+}
+
+func ipv4UDPErrorPacket(typ ipv4.ICMPType, code int, srcPort, dstPort int, checksum uint16) []byte {
+	inner := []byte{
+		byte(srcPort >> 8), byte(srcPort),
+		byte(dstPort >> 8), byte(dstPort),
+		0, udpHeaderLen,
+		byte(checksum >> 8), byte(checksum),
+	}
+	header, err := (&ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(inner),
+		TTL:      1,
+		Protocol: protocolUDP,
+		Src:      net.IPv4(198, 51, 100, 1),
+		Dst:      net.IPv4(203, 0, 113, 1),
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	var body icmp.MessageBody
+	if typ == ipv4.ICMPTypeTimeExceeded {
+		body = &icmp.TimeExceeded{Data: append(header, inner...)}
+	} else {
+		body = &icmp.DstUnreach{Data: append(header, inner...)}
+	}
+	packet, err := (&icmp.Message{Type: typ, Code: code, Body: body}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func TestTraceTCP(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 30)
+	icmpConn := newChanPacketConn()
+	tcpConn := newChanPacketConn()
+	var ports []int
+	tcpConn.script = func(ttl int, b []byte) {
+		h, ok := parseTCPHeader(b)
+		if !ok {
+			t.Errorf("cannot parse TCP probe")
+			return
+		}
+		ports = append(ports, h.SrcPort)
+		switch ttl {
+		case 1:
+			icmpConn.reads <- readAction{
+				packet: ipv4TCPTimeExceededPacket(h),
+				addr:   &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+			}
+		default:
+			// Unrelated segment followed by the SYN-ACK.
+			tcpConn.reads <- readAction{
+				packet: tcpReplyPacket(h.DstPort, h.SrcPort+1, h.Seq+1, tcpFlagSYN|tcpFlagACK),
+				addr:   &net.IPAddr{IP: dest},
+			}
+			tcpConn.reads <- readAction{
+				packet: tcpReplyPacket(h.DstPort, h.SrcPort, h.Seq+1, tcpFlagSYN|tcpFlagACK),
+				addr:   &net.IPAddr{IP: dest},
+			}
+		}
+	}
+	tr := Tracer{
+		MaxHops:    5,
+		HopTimeout: time.Second,
+		Probes:     2,
+		Method:     MethodTCP,
+	}
+	cfg := tr.traceConfig(dest)
+	pr := newTCPProberWithConn(cfg, net.IPv4(198, 51, 100, 1), dest, icmpConn, tcpConn)
+	hops, err := collectTraceWithProber(tr, dest, icmpConn, pr)
+	pr.Close()
+	icmpConn.Close()
+	if err != nil {
+		t.Fatalf("Trace() error = %v", err)
+	}
+	if got, want := tcpConn.dsts, []int{443, 443, 443, 443, 443, 443, 443}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destination ports = %v, want %v", got, want)
+	}
+	for i := 1; i < len(ports); i++ {
+		if ports[i] != ports[0]+i {
+			t.Fatalf("source ports = %v, want incrementing ports", ports)
+		}
+	}
+	if got, want := len(hops), 2; got != want {
+		t.Fatalf("len(hops) = %d, want %d", got, want)
+	}
+	if got, want := hops[0].IPs(), []net.IP{net.IPv4(192, 0, 2, 1)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 1 IPs = %v, want %v", got, want)
+	}
+	if got, want := hops[1].IPs(), []net.IP{dest}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hop 2 IPs = %v, want %v", got, want)
+	}
+}
+
+// chanPacketConn is a packetConn safe for concurrent use whose Read blocks
+// until a packet is queued on reads or the conn is closed.
+type chanPacketConn struct {
+	reads  chan readAction
+	closed chan struct{}
+	once   sync.Once
+	ttl    int
+	dsts   []int
+	script func(ttl int, b []byte)
+}
+
+func newChanPacketConn() *chanPacketConn {
+	return &chanPacketConn{
+		reads:  make(chan readAction, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *chanPacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *chanPacketConn) Write(b []byte, dst net.Addr) (int, error) {
+	if h, ok := parseTCPHeader(b); ok {
+		c.dsts = append(c.dsts, h.DstPort)
+	}
+	if c.script != nil {
+		c.script(c.ttl, b)
+	}
+	return len(b), nil
+}
+
+func (c *chanPacketConn) Read(b []byte) (int, net.Addr, error) {
+	select {
+	case action := <-c.reads:
+		if action.err != nil {
+			return 0, action.addr, action.err
+		}
+		return copy(b, action.packet), action.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed connection")
+	}
+}
+
+func (c *chanPacketConn) SetReadDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (c *chanPacketConn) SetHopLimit(hoplim int) error {
+	c.ttl = hoplim
+	return nil
+}
+
+func tcpReplyPacket(srcPort, dstPort int, ack uint32, flags uint8) []byte {
+	b := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = tcpHeaderLen / 4 << 4
+	b[13] = flags
+	return b
+}
+
+func ipv4TCPTimeExceededPacket(h tcpHeader) []byte {
+	inner := make([]byte, 8)
+	binary.BigEndian.PutUint16(inner[0:2], uint16(h.SrcPort))
+	binary.BigEndian.PutUint16(inner[2:4], uint16(h.DstPort))
+	binary.BigEndian.PutUint32(inner[4:8], h.Seq)
+	header, err := (&ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + tcpHeaderLen + 4,
+		TTL:      1,
+		Protocol: protocolTCP,
+		Src:      net.IPv4(198, 51, 100, 1),
+		Dst:      net.IPv4(203, 0, 113, 1),
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	packet, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{Data: append(header, inner...)},
+	}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func TestPingWithConn(t *testing.T) {
+	conn := newChanPacketConn()
+	defer conn.Close()
+	cfg := pingConfig{family: 4, count: 4, interval: time.Millisecond, timeout: 50 * time.Millisecond, packetSize: 8, ttl: 64}
+	pr := newICMPProber(traceConfig{family: 4, packetSize: 8}, nil, net.IPv4(192, 0, 2, 1), conn)
+	n := 0
+	conn.script = func(ttl int, b []byte) {
+		m, err := icmp.ParseMessage(protocolICMP, b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n++
+		if n == 3 {
+			// Lost.
+			return
+		}
+		reply, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: m.Body}).Marshal(nil)
+		conn.reads <- readAction{packet: reply}
+		if n == 2 {
+			conn.reads <- readAction{packet: reply}
+		}
+	}
+	rtts, dups, err := pingWithConn(context.Background(), cfg, conn, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtts) != 4 || rtts[0] < 0 || rtts[1] < 0 || rtts[2] != -1 || rtts[3] < 0 {
+		t.Errorf("rtts = %v, want the third one lost", rtts)
+	}
+	if dups != 1 {
+		t.Errorf("dups = %d, want 1", dups)
+	}
+}
+
+// stampedConn is a chanPacketConn reporting fixed send and receive times.
+type stampedConn struct {
+	*chanPacketConn
+	sent, received time.Time
+}
+
+func (c stampedConn) writeTimed(b []byte, dst net.Addr) (time.Time, error) {
+	_, err := c.Write(b, dst)
+	return c.sent, err
+}
+
+func (c stampedConn) readStamped(b []byte) (int, net.Addr, int, time.Time, error) {
+	n, src, err := c.Read(b)
+	return n, src, 0, c.received, err
+}
+
+func TestProbeKernelTimestamps(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 1)
+	sent := time.Now().Add(-time.Second)
+	conn := stampedConn{newChanPacketConn(), sent, sent.Add(5 * time.Millisecond)}
+	defer conn.Close()
+	conn.script = func(ttl int, b []byte) {
+		m, err := icmp.ParseMessage(protocolICMP, b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		echo := m.Body.(*icmp.Echo)
+		conn.reads <- readAction{packet: ipv4EchoReplyPacket(echo.ID, echo.Seq), addr: &net.IPAddr{IP: dest}}
+	}
+	tr := Tracer{}
+	cfg := tr.traceConfig(dest)
+	pr := newICMPProber(cfg, nil, dest, conn)
+	results, err := tr.probe(context.Background(), conn, 4, pr, []int{1}, []probeID{{}}, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := results[0].info; info.RTT != 5*time.Millisecond || info.Clock != ClockKernel {
+		t.Errorf("RTT = %s with the %s clock, want 5ms with the kernel one", info.RTT, info.Clock)
+	}
+}
+
+func TestProbeBleachedDSCP(t *testing.T) {
+	dest := net.IPv4(203, 0, 113, 1)
+	conn := newChanPacketConn()
+	defer conn.Close()
+	conn.script = func(ttl int, b []byte) {
+		// The router quotes the probe with its DSCP cleared.
+		header, err := (&ipv4.Header{
+			Version:  4,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + len(b),
+			TTL:      1,
+			Protocol: protocolICMP,
+			Src:      net.IPv4(198, 51, 100, 1),
+			Dst:      dest,
+		}).Marshal()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		packet, err := (&icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: append(header, b...)},
+		}).Marshal(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.reads <- readAction{packet: packet, addr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}}
+	}
+	tr := Tracer{TOS: 0xb8}
+	cfg := tr.traceConfig(dest)
+	pr := newICMPProber(cfg, nil, dest, conn)
+	results, err := tr.probe(context.Background(), conn, 4, pr, []int{1}, []probeID{{}}, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := results[0].info
+	if info.Reply == nil || info.Reply.QuotedTOS == nil || *info.Reply.QuotedTOS != 0 {
+		t.Fatalf("reply = %+v, want a quoted TOS of 0", info.Reply)
+	}
+	if got, want := info.Modifications, []string{ModDSCP}; !reflect.DeepEqual(got, want) {
+		t.Errorf("modifications = %v, want %v", got, want)
+	}
+	b, err := json.Marshal(info.Reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"QuotedTOS":0`) {
+		t.Errorf("JSON reply %s lacks the quoted TOS", b)
+	}
+}
+
+func TestProbesDonePerFlow(t *testing.T) {
+	ttls := []int{2, 3, 3}
+	ids := []probeID{{seq: 0, flow: 0}, {seq: 1, flow: 0}, {seq: 2, flow: 1}}
+	// The destination replied at TTL 2 to flow 0 only.
+	lastTTL := map[uint16]int{0: 2}
+	if probesDone(ttls, ids, []bool{true, false, false}, lastTTL) {
+		t.Fatal("done before the probe of flow 1 is answered")
+	}
+	if !probesDone(ttls, ids, []bool{true, false, true}, lastTTL) {
+		t.Fatal("not done once the probes up to the destination of each flow are answered")
+	}
+}
@@ -6,6 +6,7 @@ package traceroute
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"syscall"
@@ -26,8 +27,17 @@ type windowsTracer struct {
 	family  int
 	handle  syscall.Handle
 	request []byte
+	// flags are the IP_FLAG_* flags of the requests.
+	flags byte
+	// src is the source address of the requests, if set.
+	src net.IP
+	// tos is the TOS or traffic class of the requests.
+	tos byte
 }
 
+// ipFlagDF sets the DF bit of IPv4 requests.
+const ipFlagDF = 0x02
+
 type ipOptionInformation32 struct {
 	TTL         byte
 	TOS         byte
@@ -36,32 +46,85 @@ type ipOptionInformation32 struct {
 	OptionsData uint32
 }
 
-func (t *Tracer) Trace(ctx context.Context, dest net.IP, c chan Hop) error {
-	cfg := t.traceConfig(dest)
+func (t *Tracer) openProbe(ctx context.Context, cfg traceConfig, dest net.IP) (probe batchProbeFunc, close func(), err error) {
+	if cfg.method != MethodICMP {
+		return nil, nil, &Error{Kind: ErrUnsupported, Op: fmt.Sprintf("method %v", cfg.method)}
+	}
+	if cfg.paris {
+		return nil, nil, &Error{Kind: ErrUnsupported, Op: "Paris mode"}
+	}
+	if cfg.class.flowLabel != 0 {
+		return nil, nil, &Error{Kind: ErrUnsupported, Op: "flow label"}
+	}
 
-	wt, err := newWindowsTracer(cfg.family, cfg.packetSize)
+	wt, err := newWindowsTracer(cfg.family, cfg.packetSize, cfg.bind)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer wt.Close()
+	wt.tos = byte(cfg.class.tos)
 
-	return t.traceWithFunc(ctx, cfg, c, func(ttl int, timeout time.Duration) (HopInfo, bool, error) {
-		return wt.probe(ctx, ttl, dest, timeout)
-	})
+	return func(ttls []int, timeout time.Duration, result func(int, probeResult)) error {
+		for i, ttl := range ttls {
+			start := time.Now()
+			info, last, err := wt.probe(ctx, ttl, dest, timeout)
+			if err != nil {
+				return err
+			}
+			info.Sent = start
+			result(i, probeResult{info: info, last: last})
+			if last {
+				break
+			}
+		}
+		return nil
+	}, func() { _ = wt.Close() }, nil
 }
 
-func newWindowsTracer(family int, packetSize int) (*windowsTracer, error) {
-	var (
-		handle syscall.Handle
-		err    error
-	)
+// TraceMultipath is not supported on Windows as the ICMP API does not give
+// control over the probe flow.
+func (t *Tracer) TraceMultipath(ctx context.Context, dest net.IP) (*Graph, error) {
+	return nil, &Error{Kind: ErrUnsupported, Op: "multipath tracing"}
+}
+
+// openPMTUProbe returns the function sending Echo requests of a given size
+// with the DF bit set. IPv6 requests are fragmented by the system above the
+// path MTU it knows, they can thus not probe it.
+func (t *Tracer) openPMTUProbe(ctx context.Context, cfg traceConfig, dest net.IP) (probe pmtuProbeFunc, close func(), err error) {
+	if cfg.family == 6 {
+		return nil, nil, &Error{Kind: ErrUnsupported, Op: "IPv6 path MTU discovery"}
+	}
+	wt, err := newWindowsTracer(cfg.family, 0, cfg.bind)
+	if err != nil {
+		return nil, nil, err
+	}
+	wt.flags = ipFlagDF
+	wt.tos = byte(cfg.class.tos)
+	return func(size int, timeout time.Duration) (HopInfo, error) {
+		wt.request = make([]byte, size-pmtuOverhead(cfg.family))
+		info, _, err := wt.probe(ctx, cfg.maxHops, dest, timeout)
+		if errors.Is(err, syscall.Errno(windowsIPPacketTooBig)) {
+			// Too big for the local interface.
+			return HopInfo{RTT: -1, Reply: windowsReply(cfg.family, windowsIPPacketTooBig)}, nil
+		}
+		return info, err
+	}, func() { _ = wt.Close() }, nil
+}
+
+// newWindowsTracer opens an ICMP handle sending requests from the address
+// of b. Requests cannot be bound to an interface otherwise.
+func newWindowsTracer(family int, packetSize int, b binding) (*windowsTracer, error) {
+	b, err := b.forFamily(family)
+	if err != nil {
+		return nil, err
+	}
+	var handle syscall.Handle
 	switch family {
 	case 4:
 		handle, err = icmpCreateFile()
 	case 6:
 		handle, err = icmp6CreateFile()
 	default:
-		return nil, fmt.Errorf("unsupported family %d", family)
+		return nil, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("family %d", family)}
 	}
 	if err != nil {
 		return nil, err
@@ -70,6 +133,7 @@ func newWindowsTracer(family int, packetSize int) (*windowsTracer, error) {
 		family:  family,
 		handle:  handle,
 		request: make([]byte, packetSize),
+		src:     b.src,
 	}, nil
 }
 
@@ -87,7 +151,7 @@ func (t *windowsTracer) probe(ctx context.Context, ttl int, dest net.IP, hopTime
 	if err != nil {
 		return HopInfo{}, false, err
 	}
-	opts := ipOptionInformation32{TTL: byte(ttl)}
+	opts := ipOptionInformation32{TTL: byte(ttl), TOS: t.tos, Flags: t.flags}
 	switch t.family {
 	case 4:
 		reply, err := t.probeIPv4(dest, opts, timeout)
@@ -102,14 +166,18 @@ func (t *windowsTracer) probe(ctx context.Context, ttl int, dest net.IP, hopTime
 		}
 		return parseWindowsIPv6Reply(reply)
 	default:
-		return HopInfo{}, false, fmt.Errorf("unsupported family %d", t.family)
+		return HopInfo{}, false, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("family %d", t.family)}
 	}
 }
 
 func (t *windowsTracer) probeIPv4(dest net.IP, opts ipOptionInformation32, timeout time.Duration) ([]byte, error) {
 	ip4 := dest.To4()
 	if ip4 == nil {
-		return nil, fmt.Errorf("invalid IPv4 destination %v", dest)
+		return nil, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("invalid IPv4 destination %v", dest)}
+	}
+	var src uint32
+	if t.src != nil {
+		src = ipv4Address(t.src.To4())
 	}
 	reply := make([]byte, windowsIPv4ReplyPrefixSize+len(t.request)+64)
 	r1, _, e1 := procIcmpSendEcho2Ex.Call(
@@ -117,7 +185,7 @@ func (t *windowsTracer) probeIPv4(dest net.IP, opts ipOptionInformation32, timeo
 		0,
 		0,
 		0,
-		0,
+		uintptr(src),
 		uintptr(ipv4Address(ip4)),
 		bytesPtr(t.request),
 		uintptr(len(t.request)),
@@ -131,9 +199,9 @@ func (t *windowsTracer) probeIPv4(dest net.IP, opts ipOptionInformation32, timeo
 			return timeoutWindowsIPv4Reply(), nil
 		}
 		if e1 != syscall.Errno(0) {
-			return nil, fmt.Errorf("IcmpSendEcho2Ex: %w", e1)
+			return nil, socketError("IcmpSendEcho2Ex", e1)
 		}
-		return nil, fmt.Errorf("IcmpSendEcho2Ex: no replies")
+		return nil, &Error{Kind: ErrSocket, Op: "IcmpSendEcho2Ex", Err: errors.New("no replies")}
 	}
 	return reply, nil
 }
@@ -141,9 +209,10 @@ func (t *windowsTracer) probeIPv4(dest net.IP, opts ipOptionInformation32, timeo
 func (t *windowsTracer) probeIPv6(dest net.IP, opts ipOptionInformation32, timeout time.Duration) ([]byte, error) {
 	ip6 := dest.To16()
 	if ip6 == nil || dest.To4() != nil {
-		return nil, fmt.Errorf("invalid IPv6 destination %v", dest)
+		return nil, &Error{Kind: ErrUnsupportedFamily, Op: fmt.Sprintf("invalid IPv6 destination %v", dest)}
 	}
 	src := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(src.Addr[:], t.src.To16())
 	dst := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
 	copy(dst.Addr[:], ip6)
 	reply := make([]byte, windowsIPv6ReplyPrefixSize+len(t.request)+128)
@@ -166,9 +235,9 @@ func (t *windowsTracer) probeIPv6(dest net.IP, opts ipOptionInformation32, timeo
 			return timeoutWindowsIPv6Reply(), nil
 		}
 		if e1 != syscall.Errno(0) {
-			return nil, fmt.Errorf("Icmp6SendEcho2: %w", e1)
+			return nil, socketError("Icmp6SendEcho2", e1)
 		}
-		return nil, fmt.Errorf("Icmp6SendEcho2: no replies")
+		return nil, &Error{Kind: ErrSocket, Op: "Icmp6SendEcho2", Err: errors.New("no replies")}
 	}
 	return reply, nil
 }
@@ -178,9 +247,9 @@ func icmpCreateFile() (syscall.Handle, error) {
 	handle := syscall.Handle(r1)
 	if handle == syscall.InvalidHandle {
 		if e1 != syscall.Errno(0) {
-			return 0, fmt.Errorf("IcmpCreateFile: %w", e1)
+			return 0, socketError("IcmpCreateFile", e1)
 		}
-		return 0, fmt.Errorf("IcmpCreateFile: invalid handle")
+		return 0, &Error{Kind: ErrSocket, Op: "IcmpCreateFile", Err: errors.New("invalid handle")}
 	}
 	return handle, nil
 }
@@ -190,9 +259,9 @@ func icmp6CreateFile() (syscall.Handle, error) {
 	handle := syscall.Handle(r1)
 	if handle == syscall.InvalidHandle {
 		if e1 != syscall.Errno(0) {
-			return 0, fmt.Errorf("Icmp6CreateFile: %w", e1)
+			return 0, socketError("Icmp6CreateFile", e1)
 		}
-		return 0, fmt.Errorf("Icmp6CreateFile: invalid handle")
+		return 0, &Error{Kind: ErrSocket, Op: "Icmp6CreateFile", Err: errors.New("invalid handle")}
 	}
 	return handle, nil
 }
@@ -210,15 +279,15 @@ func icmpCloseHandle(handle syscall.Handle) error {
 
 func probeTimeout(ctx context.Context, timeout time.Duration) (time.Duration, error) {
 	if err := ctx.Err(); err != nil {
-		return 0, err
+		return 0, canceledError(err)
 	}
 	if deadline, ok := ctx.Deadline(); ok {
 		remaining := time.Until(deadline)
 		if remaining <= 0 {
 			if err := ctx.Err(); err != nil {
-				return 0, err
+				return 0, canceledError(err)
 			}
-			return 0, context.DeadlineExceeded
+			return 0, canceledError(context.DeadlineExceeded)
 		}
 		if remaining < timeout {
 			timeout = remaining
@@ -0,0 +1,54 @@
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const udpHeaderLen = 8
+
+type udpHeader struct {
+	SrcPort  int
+	DstPort  int
+	Length   int
+	Checksum uint16
+}
+
+func parseUDPHeader(b []byte) (udpHeader, bool) {
+	if len(b) < udpHeaderLen {
+		return udpHeader{}, false
+	}
+	return udpHeader{
+		SrcPort:  int(binary.BigEndian.Uint16(b[0:2])),
+		DstPort:  int(binary.BigEndian.Uint16(b[2:4])),
+		Length:   int(binary.BigEndian.Uint16(b[4:6])),
+		Checksum: binary.BigEndian.Uint16(b[6:8]),
+	}, true
+}
+
+// udpProbeChecksum maps the probe number seq to a checksum value that can
+// be put on the wire as is: 0 means "no checksum" and 0xffff is how a
+// computed checksum of 0 is transmitted.
+func udpProbeChecksum(seq uint16) uint16 {
+	return 1 + seq%0xfffe
+}
+
+// setUDPChecksum writes the first two bytes of payload so that the checksum
+// of the UDP datagram computed by the kernel ends up equal to sum. The
+// payload must be at least two bytes long.
+func setUDPChecksum(payload []byte, src, dst net.IP, srcPort, dstPort int, sum uint16) {
+	payload[0], payload[1] = 0, 0
+	s := udpSum(src, dst, srcPort, dstPort, payload)
+	// The kernel sends ^fold(s + w); solve for the word w.
+	w := checksumFold(uint32(^sum) + uint32(^checksumFold(s)))
+	binary.BigEndian.PutUint16(payload[0:2], w)
+}
+
+// udpSum returns the unfolded one's complement sum of the UDP pseudo header,
+// header (with a zero checksum) and payload.
+func udpSum(src, dst net.IP, srcPort, dstPort int, payload []byte) uint32 {
+	length := udpHeaderLen + len(payload)
+	s := pseudoHeaderSum(src, dst, protocolUDP, length)
+	s += uint32(srcPort) + uint32(dstPort) + uint32(length)
+	return checksumAdd(s, payload)
+}
@@ -0,0 +1,42 @@
+package traceroute
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetUDPChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		size     int
+	}{
+		{"IPv4", net.IPv4(192, 0, 2, 1).To4(), net.IPv4(45, 90, 28, 0).To4(), 52},
+		{"IPv4 odd size", net.IPv4(192, 0, 2, 1).To4(), net.IPv4(45, 90, 30, 0).To4(), 33},
+		{"IPv6", net.ParseIP("2001:db8::1"), net.ParseIP("2a07:a8c0::"), 52},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			for i := range payload {
+				payload[i] = byte(i * 7)
+			}
+			for _, seq := range []uint16{0, 1, 0x1234, 0xfffd, 0xfffe, 0xffff} {
+				want := udpProbeChecksum(seq)
+				setUDPChecksum(payload, tt.src, tt.dst, 40000, 53, want)
+				if got := udpChecksum(tt.src, tt.dst, 40000, 53, payload); got != want {
+					t.Errorf("seq %d: checksum = %#04x, want %#04x", seq, got, want)
+				}
+			}
+		})
+	}
+}
+
+// udpChecksum computes the checksum of a UDP datagram as found on the wire.
+func udpChecksum(src, dst net.IP, srcPort, dstPort int, payload []byte) uint16 {
+	c := ^checksumFold(udpSum(src, dst, srcPort, dstPort, payload))
+	if c == 0 {
+		c = 0xffff
+	}
+	return c
+}
@@ -8,10 +8,15 @@ import (
 )
 
 const (
-	windowsIPSuccess           = 0
-	windowsIPReqTimedOut       = 11010
-	windowsIPTTLExpiredTransit = 11013
-	windowsIPTTLExpiredReassem = 11014
+	windowsIPSuccess             = 0
+	windowsIPDestNetUnreachable  = 11002
+	windowsIPDestHostUnreachable = 11003
+	windowsIPDestProtUnreachable = 11004
+	windowsIPDestPortUnreachable = 11005
+	windowsIPPacketTooBig        = 11009
+	windowsIPReqTimedOut         = 11010
+	windowsIPTTLExpiredTransit   = 11013
+	windowsIPTTLExpiredReassem   = 11014
 
 	windowsIPv4ReplyPrefixSize = 28
 	windowsIPv6ReplyPrefixSize = 36
@@ -23,21 +28,23 @@ const (
 
 func parseWindowsIPv4Reply(reply []byte) (HopInfo, bool, error) {
 	if len(reply) < windowsIPv4ReplyPrefixSize {
-		return HopInfo{}, false, fmt.Errorf("short ICMP reply buffer: got %d bytes", len(reply))
+		return HopInfo{}, false, &Error{Kind: ErrParse, Op: "cannot parse ICMP reply", Err: fmt.Errorf("short buffer: got %d bytes", len(reply))}
 	}
 	status := binary.LittleEndian.Uint32(reply[4:8])
 	if status == windowsIPReqTimedOut {
 		return HopInfo{RTT: -1}, false, nil
 	}
 	return HopInfo{
-		IP:  net.IPv4(reply[0], reply[1], reply[2], reply[3]),
-		RTT: time.Duration(binary.LittleEndian.Uint32(reply[8:12])) * time.Millisecond,
+		IP:    net.IPv4(reply[0], reply[1], reply[2], reply[3]),
+		RTT:   time.Duration(binary.LittleEndian.Uint32(reply[8:12])) * time.Millisecond,
+		Reply: windowsReply(4, status),
+		Clock: ClockSystem,
 	}, !windowsTTLExpired(status), nil
 }
 
 func parseWindowsIPv6Reply(reply []byte) (HopInfo, bool, error) {
 	if len(reply) < windowsIPv6ReplyPrefixSize {
-		return HopInfo{}, false, fmt.Errorf("short ICMPv6 reply buffer: got %d bytes", len(reply))
+		return HopInfo{}, false, &Error{Kind: ErrParse, Op: "cannot parse ICMPv6 reply", Err: fmt.Errorf("short buffer: got %d bytes", len(reply))}
 	}
 	status := binary.LittleEndian.Uint32(reply[windowsIPv6StatusOffset : windowsIPv6StatusOffset+4])
 	if status == windowsIPReqTimedOut {
@@ -45,11 +52,39 @@ func parseWindowsIPv6Reply(reply []byte) (HopInfo, bool, error) {
 	}
 	ip := append(net.IP(nil), reply[windowsIPv6AddressOffset:windowsIPv6AddressOffset+net.IPv6len]...)
 	return HopInfo{
-		IP:  ip,
-		RTT: time.Duration(binary.LittleEndian.Uint32(reply[windowsIPv6RTTOffset:windowsIPv6RTTOffset+4])) * time.Millisecond,
+		IP:    ip,
+		RTT:   time.Duration(binary.LittleEndian.Uint32(reply[windowsIPv6RTTOffset:windowsIPv6RTTOffset+4])) * time.Millisecond,
+		Reply: windowsReply(6, status),
+		Clock: ClockSystem,
 	}, !windowsTTLExpired(status), nil
 }
 
+// windowsReplyCodes maps the status of replies to their ICMP type and code,
+// for IPv4 and IPv6.
+var windowsReplyCodes = map[uint32][2][2]int{
+	windowsIPSuccess:             {{0, 0}, {129, 0}},
+	windowsIPDestNetUnreachable:  {{3, 0}, {1, 0}},
+	windowsIPDestHostUnreachable: {{3, 1}, {1, 3}},
+	windowsIPDestProtUnreachable: {{3, 2}, {1, 1}},
+	windowsIPDestPortUnreachable: {{3, 3}, {1, 4}},
+	windowsIPPacketTooBig:        {{3, 4}, {2, 0}},
+	windowsIPTTLExpiredTransit:   {{11, 0}, {3, 0}},
+	windowsIPTTLExpiredReassem:   {{11, 1}, {3, 1}},
+}
+
+// windowsReply returns the reply matching status, nil if its ICMP type is
+// unknown. For IPv6, 11004 stands for "administratively prohibited".
+func windowsReply(family int, status uint32) *Reply {
+	codes, found := windowsReplyCodes[status]
+	if !found {
+		return nil
+	}
+	if family == 4 {
+		return &Reply{Proto: "icmp", Type: codes[0][0], Code: codes[0][1]}
+	}
+	return &Reply{Proto: "icmpv6", Type: codes[1][0], Code: codes[1][1]}
+}
+
 func windowsTTLExpired(status uint32) bool {
 	return status == windowsIPTTLExpiredTransit || status == windowsIPTTLExpiredReassem
 }
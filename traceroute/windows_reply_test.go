@@ -19,8 +19,10 @@ func TestParseWindowsIPv4Reply(t *testing.T) {
 		t.Fatalf("parseWindowsIPv4Reply() error = %v", err)
 	}
 	if got, want := info, (HopInfo{
-		IP:  net.IPv4(45, 90, 28, 0),
-		RTT: 17 * time.Millisecond,
+		IP:    net.IPv4(45, 90, 28, 0),
+		RTT:   17 * time.Millisecond,
+		Reply: &Reply{Proto: "icmp", Type: 11, Code: 0},
+		Clock: ClockSystem,
 	}); !reflect.DeepEqual(got, want) {
 		t.Fatalf("parseWindowsIPv4Reply() info = %#v, want %#v", got, want)
 	}
@@ -57,8 +59,10 @@ func TestParseWindowsIPv6Reply(t *testing.T) {
 		t.Fatalf("parseWindowsIPv6Reply() error = %v", err)
 	}
 	if got, want := info, (HopInfo{
-		IP:  ip,
-		RTT: 9 * time.Millisecond,
+		IP:    ip,
+		RTT:   9 * time.Millisecond,
+		Reply: &Reply{Proto: "icmpv6", Type: 129, Code: 0},
+		Clock: ClockSystem,
 	}); !reflect.DeepEqual(got, want) {
 		t.Fatalf("parseWindowsIPv6Reply() info = %#v, want %#v", got, want)
 	}